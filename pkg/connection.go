@@ -3,15 +3,14 @@ package optimizedconn
 import (
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/addr"
 	"github.com/scionproto/scion/pkg/snet"
-	"github.com/scionproto/scion/private/topology"
 )
 
 type MergedConn interface {
@@ -29,50 +28,93 @@ type OptimizedSCIONConn struct {
 	listenAddr   *net.UDPAddr
 	packetParser *PacketParser
 
-	// Only populated, if user opened connection with Dial
+	// Only populated, if user opened connection with Dial or a remote was learned.
 	// Otherwise the connection does not support send functionality.
-	remoteAddr       *snet.UDPAddr
-	nextHop          *net.UDPAddr
-	packetSerializer *PacketSerializer
+	sendState atomic.Pointer[sendState]
+	// Only populated in multipath mode, Write then uses these states instead of sendState.
+	multipath atomic.Pointer[multipathState]
 
 	connectivityContext *ConnectivityContext
+	options             connOptions
 	replyPather         snet.ReplyPather
 	counter             uint64
+
+	// closeOnce releases connectivityContext on the first Close.
+	closeOnce sync.Once
+
+	// Only populated, if the path was looked up by Dial.
+	pathRefresher *pathRefresher
+	// pathMtx serializes replacing sendState and multipath, so that lookups in flight
+	// cannot override a path pinned with SetPath or SetRemote.
+	pathMtx sync.Mutex
+	// pinned is set once the application chose the path with SetPath or SetRemote. It is only set with pathMtx held.
+	pinned atomic.Bool
+	// learned is set once the remote was learned from a received packet, the source policy applies from then on.
+	learned atomic.Bool
+	// dropped counts the packets Read discarded because they were not sent by the remote.
+	dropped atomic.Uint64
+}
+
+// sendState contains everything Write needs to reach the remote. It is always replaced as a whole,
+// so that concurrent writers never combine the serializer of one path with the next hop of another.
+type sendState struct {
+	remoteAddr       *snet.UDPAddr
+	nextHop          *net.UDPAddr
+	path             snet.Path
+	packetSerializer *PacketSerializer
+	// expiry is cached, since the metadata of daemon paths is copied on every access.
+	expiry time.Time
 }
 
 var _ net.Conn = &OptimizedSCIONConn{}
 
-func Listen(listenAddr *net.UDPAddr) (*OptimizedSCIONConn, error) {
+// Listen opens a connection on listenAddr. The remote is learned from the first packet received,
+// whose payload is returned by the first Read. Packets from other sources are handled according
+// to the SourcePolicy set with WithSourcePolicy.
+func Listen(listenAddr *net.UDPAddr, opts ...Option) (*OptimizedSCIONConn, error) {
+	return ListenContext(context.Background(), listenAddr, opts...)
+}
+
+// ListenContext is like Listen, but ctx bounds the connection to the SCION daemon and the
+// lookup of the local AS. If the daemon fails or ctx is done first, a DaemonError is returned.
+func ListenContext(ctx context.Context, listenAddr *net.UDPAddr, opts ...Option) (*OptimizedSCIONConn, error) {
 
 	if listenAddr == nil || listenAddr.IP == nil || listenAddr.IP.IsUnspecified() {
-		return nil, serrors.New("listen addr is unspecified")
+		return nil, ErrUnspecifiedListenAddr
 	}
 
-	ctx := context.Background()
-	connectivityContext, err := PrepareConnectivityContext(ctx)
+	options := newConnOptions(opts)
+	connectivityContext, err := acquireConnectivityContext(ctx, options.connectivityContext)
 	if err != nil {
 		return nil, err
 	}
 
 	var udpTransportConn MergedConn
 
-	udpTransportConn, err = net.ListenUDP("udp4", listenAddr)
+	udpTransportConn, err = net.ListenUDP(listenNetwork(listenAddr), listenAddr)
 	if err != nil {
+		connectivityContext.release()
 		return nil, err
 	}
 
+	// Use the bound address, listenAddr may leave the port to the OS.
+	listenAddr = udpTransportConn.LocalAddr().(*net.UDPAddr)
+	options.logger = options.logger.With("local", listenAddr)
+
 	packetParser, err := NewPacketParser()
 
 	if err != nil {
+		udpTransportConn.Close()
+		connectivityContext.release()
 		return nil, err
 	}
 
 	optimizedSCIONConn := OptimizedSCIONConn{
 		transportConn:       udpTransportConn,
 		connectivityContext: connectivityContext,
+		options:             options,
 
 		listenAddr: listenAddr,
-		remoteAddr: nil,
 
 		packetParser: packetParser,
 
@@ -83,94 +125,160 @@ func Listen(listenAddr *net.UDPAddr) (*OptimizedSCIONConn, error) {
 	return &optimizedSCIONConn, nil
 }
 
-func Dial(listenAddr *net.UDPAddr, remoteAddr *snet.UDPAddr) (*OptimizedSCIONConn, error) {
+// Dial opens a connection to remoteAddr. If remoteAddr has no path, a path is looked up from
+// the daemon and picked by the configured PathSelector. Looked up paths are refreshed
+// before they expire. Read only returns packets sent by remoteAddr.
+func Dial(listenAddr *net.UDPAddr, remoteAddr *snet.UDPAddr, opts ...Option) (*OptimizedSCIONConn, error) {
+	return DialContext(context.Background(), listenAddr, remoteAddr, opts...)
+}
+
+// DialContext is like Dial, but ctx bounds the connection to the SCION daemon, the lookup of the
+// local AS and the path lookup. Daemon failures, including ctx being done, are returned as DaemonError.
+// ctx does not affect the connection once it is established.
+func DialContext(ctx context.Context, listenAddr *net.UDPAddr, remoteAddr *snet.UDPAddr, opts ...Option) (*OptimizedSCIONConn, error) {
 
-	oSC, err := Listen(listenAddr)
+	oSC, err := ListenContext(ctx, listenAddr, opts...)
 
 	if err != nil {
 		return nil, err
 	}
 
-	nextHop := remoteAddr.NextHop
-	if nextHop == nil && !oSC.connectivityContext.LocalIA.Equal(remoteAddr.IA) {
-		path, _ := remoteAddr.GetPath()
-		fmt.Println("Path is", path)
-		nextHop = path.UnderlayNextHop()
-		fmt.Println("Next hop is", nextHop)
-	}
+	lookupPath := remoteAddr.Path == nil
+	remoteAddr = remoteAddr.Copy()
 
-	if nextHop == nil && oSC.connectivityContext.LocalIA.Equal(remoteAddr.IA) {
-		if bytes.Compare(remoteAddr.Host.IP, oSC.listenAddr.IP) == 0 {
-			nextHop = &net.UDPAddr{
-				IP:   remoteAddr.Host.IP,
-				Port: remoteAddr.Host.Port,
-				Zone: remoteAddr.Host.Zone,
-			}
-		} else {
-			nextHop = &net.UDPAddr{
-				IP:   remoteAddr.Host.IP,
-				Port: remoteAddr.Host.Port, // topology.EndhostPort,
-				Zone: remoteAddr.Host.Zone,
-			}
+	if lookupPath && oSC.options.multipathPaths > 0 && !oSC.connectivityContext.LocalIA.Equal(remoteAddr.IA) {
+		if _, err := oSC.setMultipath(ctx, remoteAddr); err != nil {
+			oSC.Close()
+			return nil, err
 		}
-
+		oSC.pathRefresher = newPathRefresher(oSC, remoteAddr, oSC.options.pathRefreshMargin)
+		oSC.pathRefresher.start()
+		return oSC, nil
 	}
 
-	// fmt.Println("Set remote address to", remoteAddr)
-	// fmt.Println("Next hop address to", nextHop)
-
-	oSC.remoteAddr = remoteAddr
-	oSC.nextHop = nextHop
+	path, err := oSC.connectivityContext.resolvePath(ctx, remoteAddr, &oSC.options)
+	if err != nil {
+		oSC.Close()
+		return nil, err
+	}
 
-	packetSerializer, err := NewPacketSerializer(
-		oSC.connectivityContext.LocalIA,
-		oSC.listenAddr,
-		remoteAddr,
-	)
+	nextHop, err := oSC.connectivityContext.ResolveNextHop(ctx, remoteAddr, path)
+	if err != nil {
+		oSC.Close()
+		return nil, err
+	}
+	oSC.options.logger.Debug("Dialed remote", "remote", remoteAddr, "path", path, "next_hop", nextHop)
 
+	state, err := oSC.newSendState(remoteAddr, nextHop, path)
 	if err != nil {
+		oSC.Close()
 		return nil, err
 	}
+	oSC.sendState.Store(state)
 
-	oSC.packetSerializer = packetSerializer
+	if lookupPath && !oSC.connectivityContext.LocalIA.Equal(remoteAddr.IA) {
+		oSC.pathRefresher = newPathRefresher(oSC, remoteAddr, oSC.options.pathRefreshMargin)
+		oSC.pathRefresher.start()
+	}
 
 	return oSC, nil
 
 }
 
+// SetRemote makes the connection send to remoteAddr over the path set in it. Like SetPath,
+// it disables automatic path refresh, multipath and failover.
 func (oSC *OptimizedSCIONConn) SetRemote(remoteAddr *snet.UDPAddr) error {
 
-	nextHop := remoteAddr.NextHop
+	ctx, cancel := context.WithTimeout(context.Background(), pathQueryTimeout)
+	defer cancel()
+	nextHop, err := oSC.connectivityContext.ResolveNextHop(ctx, remoteAddr, nil)
+	if err != nil {
+		return err
+	}
+	oSC.options.logger.Debug("Set remote", "remote", remoteAddr, "next_hop", nextHop)
 
-	if nextHop == nil && oSC.connectivityContext.LocalIA.Equal(remoteAddr.IA) {
-		if bytes.Equal(remoteAddr.Host.IP, oSC.listenAddr.IP) {
-			nextHop = &net.UDPAddr{
-				IP:   remoteAddr.Host.IP,
-				Port: topology.EndhostPort,
-				Zone: remoteAddr.Host.Zone,
-			}
+	path, _ := remoteAddr.GetPath()
+	state, err := oSC.newSendState(remoteAddr, nextHop, path)
+	if err != nil {
+		return err
+	}
+	oSC.pathMtx.Lock()
+	oSC.pinned.Store(true)
+	oSC.multipath.Store(nil)
+	oSC.sendState.Store(state)
+	oSC.pathMtx.Unlock()
+
+	// Refreshes in flight would restore the dialed remote, they give up like after SetPath.
+	if oSC.pathRefresher != nil {
+		oSC.pathRefresher.stop()
+	}
+	return nil
+}
 
-			if oSC.udpTransportConn != nil {
-				nextHop = &net.UDPAddr{
-					IP:   remoteAddr.Host.IP,
-					Port: remoteAddr.Host.Port,
-					Zone: remoteAddr.Host.Zone,
-				}
-			}
+// SetPath pins the connection to path. Automatic path refresh, multipath and failover
+// are disabled from then on, the application is responsible for replacing the path.
+// The connection must have a remote address, otherwise ErrNotConnected is returned.
+// Expired paths are rejected with ErrPathExpired, a nil path with ErrNilPath.
+func (oSC *OptimizedSCIONConn) SetPath(path snet.Path) error {
+	if path == nil {
+		return ErrNilPath
+	}
+	current := oSC.sendState.Load()
+	if current == nil {
+		return ErrNotConnected
+	}
+	if err := checkExpiry(pathExpiry(path)); err != nil {
+		return err
+	}
 
-		} else {
-			nextHop = &net.UDPAddr{
-				IP:   remoteAddr.Host.IP,
-				Port: remoteAddr.Host.Port, // topology.EndhostPort,
-				Zone: remoteAddr.Host.Zone,
-			}
+	remoteAddr := current.remoteAddr.Copy()
+	remoteAddr.Path = dataplanePath(path)
+	remoteAddr.NextHop = nil
 
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), pathQueryTimeout)
+	defer cancel()
+	nextHop, err := oSC.connectivityContext.ResolveNextHop(ctx, remoteAddr, path)
+	if err != nil {
+		return err
+	}
+
+	state, err := oSC.newSendState(remoteAddr, nextHop, path)
+	if err != nil {
+		return err
+	}
+
+	oSC.options.logger.Debug("Pinned path", "remote", remoteAddr, "path", path, "next_hop", nextHop)
+	oSC.pathMtx.Lock()
+	oSC.pinned.Store(true)
+	oSC.multipath.Store(nil)
+	oSC.sendState.Store(state)
+	oSC.pathMtx.Unlock()
+
+	// Refreshes in flight see the pinned path and give up, so the refresher is stopped
+	// without holding pathMtx.
+	if oSC.pathRefresher != nil {
+		oSC.pathRefresher.stop()
 	}
-	fmt.Println("Set remote address to", remoteAddr)
-	fmt.Println("Next hop ", nextHop)
-	oSC.remoteAddr = remoteAddr
-	oSC.nextHop = nextHop
+	return nil
+}
+
+// storeLookedUpState replaces the send state by one of a looked up path. mS is nil
+// unless the connection is in multipath mode. If the path was pinned with SetPath
+// meanwhile, nothing is replaced and errPathPinned is returned.
+func (oSC *OptimizedSCIONConn) storeLookedUpState(state *sendState, mS *multipathState) error {
+	oSC.pathMtx.Lock()
+	defer oSC.pathMtx.Unlock()
+
+	if oSC.pinned.Load() {
+		return errPathPinned
+	}
+	oSC.sendState.Store(state)
+	oSC.multipath.Store(mS)
+	return nil
+}
+
+// newSendState prepares the serializer for sending to remoteAddr over path.
+func (oSC *OptimizedSCIONConn) newSendState(remoteAddr *snet.UDPAddr, nextHop *net.UDPAddr, path snet.Path) (*sendState, error) {
 
 	packetSerializer, err := NewPacketSerializer(
 		oSC.connectivityContext.LocalIA,
@@ -179,101 +287,193 @@ func (oSC *OptimizedSCIONConn) SetRemote(remoteAddr *snet.UDPAddr) error {
 	)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	oSC.packetSerializer = packetSerializer
-	return nil
+	packetSerializer.SetMTU(oSC.connectivityContext.pathMTU(path))
+
+	return &sendState{
+		remoteAddr:       remoteAddr,
+		nextHop:          nextHop,
+		path:             path,
+		packetSerializer: packetSerializer,
+		expiry:           pathExpiry(path),
+	}, nil
 }
 
 func (c *OptimizedSCIONConn) Close() error {
 
+	if c.pathRefresher != nil {
+		c.pathRefresher.stop()
+	}
+
+	c.closeOnce.Do(func() {
+		c.connectivityContext.release()
+	})
+
 	return c.transportConn.Close()
 }
 
+// Read receives the payload of the next packet from the remote into b. Like a connected UDP socket,
+// packets whose SCION source IA, host or port differ from the remote are dropped and counted by
+// DroppedPackets. Concurrent calls are served one after another, since they share the read buffer.
 func (c *OptimizedSCIONConn) Read(b []byte) (int, error) {
+	c.readMtx.Lock()
+	defer c.readMtx.Unlock()
 
-	n, underlay, err := c.transportConn.ReadFrom(c.packetParser.ReadBuffer)
-	// fmt.Println("READ FROM TRANSPORT ", underlay)
-
-	// fmt.Println("Underlay addr ", undAddr)
-
-	if err != nil {
-		return 0, err
-	}
-
-	// fmt.Println("Read packet")
-
-	if c.remoteAddr == nil {
-		undAddr, ok := underlay.(*net.UDPAddr)
-		//c.counter++
-		//fmt.Println("Counter ", c.counter)
-
-		if !ok {
-			return 0, fmt.Errorf("failed to parse underlay address")
-		}
-		pkt := snet.Packet{
-			Bytes: snet.Bytes(c.packetParser.ReadBuffer[:n]),
-		}
-		err := pkt.Decode()
+	for {
+		n, underlay, err := c.transportConn.ReadFrom(c.packetParser.ReadBuffer)
 		if err != nil {
 			return 0, err
 		}
 
-		remoteAddr := pkt.Source
-		rpath, ok := pkt.Path.(snet.RawPath)
-		if !ok {
-			return 0, fmt.Errorf("expected RawPath, got %T", pkt.Path)
+		if c.packetParser.NextHeader() == SCION_PROTOCOL_NUMBER_SCMP {
+			// Only SCMP errors quoting a packet sent to the remote are processed, others are dropped.
+			pkt := snet.Packet{
+				Bytes: snet.Bytes(c.packetParser.ReadBuffer[:n]),
+			}
+			state := c.sendState.Load()
+			if pkt.Decode() != nil || state == nil ||
+				!quotesPacketTo(&pkt, c.connectivityContext.LocalIA, uint16(c.listenAddr.Port), state.remoteAddr) {
+				c.dropped.Add(1)
+				continue
+			}
+			// With failover, SCMP errors are consumed by the failover, they are never returned to the caller.
+			if c.options.failover != nil {
+				c.handleSCMP(&pkt)
+				continue
+			}
+			if sE := newSCMPError(&pkt); sE != nil {
+				return 0, sE
+			}
+			continue
 		}
 
-		replyPath, err := c.replyPather.ReplyPath(rpath)
-		if err != nil {
-			return 0, fmt.Errorf("creating reply path: %s", err)
+		state := c.sendState.Load()
+		if state == nil {
+			return c.learnRemote(n, underlay, b)
 		}
 
-		udp, ok := pkt.Payload.(snet.UDPPayload)
-		if !ok {
-			return 0, fmt.Errorf("unexpected payload")
+		ia, src, err := c.packetParser.Source(n)
+		if err != nil {
+			c.dropped.Add(1)
+			continue
+		}
+		if !isSource(state.remoteAddr, ia, src) {
+			if c.learned.Load() {
+				switch c.options.sourcePolicy {
+				case SourceFollow:
+					return c.learnRemote(n, underlay, b)
+				case SourceReject:
+					return 0, &UnexpectedSourceError{
+						Source: snet.SCIONAddress{IA: ia, Host: addr.HostIP(src.Addr())},
+						Port:   src.Port(),
+					}
+				}
+			}
+			c.dropped.Add(1)
+			continue
+		}
+		if c.options.checkDestination && !c.isDestination(n) {
+			c.dropped.Add(1)
+			continue
 		}
 
-		// fmt.Println("Set remote address to", remoteAddr)
-		destAddr := fmt.Sprintf("%s:%d", remoteAddr, udp.SrcPort)
+		return c.packetParser.Parse(n, b)
+	}
+}
 
-		destScionAddr, err := snet.ParseUDPAddr(destAddr)
-		if err != nil {
-			return 0, err
-		}
-		destScionAddr.Path = replyPath
-		destScionAddr.NextHop = undAddr
-		c.SetRemote(destScionAddr)
-		return 0, nil
-	} else {
-		payloadLen, err := c.packetParser.Parse(n, b)
+// isDestination reports whether the packet of length n in the read buffer is addressed to the local address of the connection.
+func (c *OptimizedSCIONConn) isDestination(n int) bool {
+	ia, dst, err := c.packetParser.Destination(n)
+	if err != nil {
+		return false
+	}
+	localAddr := c.listenAddr.AddrPort()
+	return c.connectivityContext.LocalIA.Equal(ia) && localAddr.Addr().Unmap() == dst.Addr() && localAddr.Port() == dst.Port()
+}
 
-		if err != nil {
-			return 0, err
-		}
+// DroppedPackets returns the number of packets Read dropped, because they were not sent by the remote
+// or, with WithDestinationCheck, were not addressed to the connection. SCMP messages that do not
+// quote a packet sent to the remote by the connection are counted as well.
+func (c *OptimizedSCIONConn) DroppedPackets() uint64 {
+	return c.dropped.Load()
+}
+
+// learnRemote makes the source of the packet of length n in the read buffer the remote of the connection,
+// replies are sent over the reverse of its path. The payload of the packet is copied into b.
+func (c *OptimizedSCIONConn) learnRemote(n int, underlay net.Addr, b []byte) (int, error) {
+	undAddr, ok := underlay.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("%w: underlay %T", ErrUnsupportedAddr, underlay)
+	}
+	pkt := snet.Packet{
+		Bytes: snet.Bytes(c.packetParser.ReadBuffer[:n]),
+	}
+	if err := pkt.Decode(); err != nil {
+		return 0, err
+	}
+
+	rpath, ok := pkt.Path.(snet.RawPath)
+	if !ok {
+		return 0, fmt.Errorf("%w: %T, expected snet.RawPath", ErrUnsupportedPath, pkt.Path)
+	}
+	// The reply pather reverses the path in place, it must not work on the read buffer.
+	rpath.Raw = bytes.Clone(rpath.Raw)
+	replyPath, err := c.replyPather.ReplyPath(rpath)
+	if err != nil {
+		return 0, fmt.Errorf("creating reply path: %w", err)
+	}
 
-		return payloadLen, nil
+	udp, ok := pkt.Payload.(snet.UDPPayload)
+	if !ok {
+		return 0, &UnknownNextHeaderError{NextHeader: c.packetParser.NextHeader()}
+	}
+	if pkt.Source.Host.Type() != addr.HostTypeIP {
+		return 0, fmt.Errorf("%w: source %s", ErrNotIPHost, pkt.Source.Host)
+	}
+
+	remoteAddr := &snet.UDPAddr{
+		IA: pkt.Source.IA,
+		Host: &net.UDPAddr{
+			IP:   pkt.Source.Host.IP().AsSlice(),
+			Port: int(udp.SrcPort),
+		},
+		Path:    replyPath,
+		NextHop: undAddr,
+	}
+	if err := c.SetRemote(remoteAddr); err != nil {
+		return 0, err
 	}
+	c.learned.Store(true)
 
+	return copy(b, udp.Payload), nil
 }
 
+// Write sends b to the remote. If the path expired because it could not be refreshed in time,
+// ErrPathExpired is returned.
 func (c *OptimizedSCIONConn) Write(b []byte) (int, error) {
 
-	if c.nextHop == nil || c.remoteAddr == nil || c.packetSerializer == nil {
-		fmt.Println("Connection does not support send functionality")
-		return 0, errors.New("Connection does not support send functionality")
+	state := c.sendState.Load()
+	if mS := c.multipath.Load(); mS != nil {
+		state = mS.next(c.options.multipathScheduler, b)
+	}
+	if state == nil || state.nextHop == nil {
+		return 0, ErrNotConnected
 	}
+	if err := checkExpiry(state.expiry); err != nil {
+		return 0, err
+	}
+
+	bufferPtr := getPacketBuffer(state.packetSerializer)
+	defer packetBuffers.Put(bufferPtr)
 
-	buffer, err := c.packetSerializer.Serialize(b)
+	buffer, err := state.packetSerializer.SerializeTo(*bufferPtr, b)
 	if err != nil {
 		return 0, err
 	}
 
-	// fmt.Println("Write packet to", c.nextHop)
-
-	_, err = c.transportConn.WriteTo(buffer, c.nextHop)
+	_, err = c.transportConn.WriteTo(buffer, state.nextHop)
 
 	if err != nil {
 		return 0, err
@@ -281,12 +481,66 @@ func (c *OptimizedSCIONConn) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// MaxPayloadSize returns the largest payload Write accepts without returning a MessageTooBigError.
+// It returns 0 if the connection has no remote address yet.
+func (c *OptimizedSCIONConn) MaxPayloadSize() int {
+	if mS := c.multipath.Load(); mS != nil {
+		maxPayloadSize := mS.states[0].packetSerializer.MaxPayloadSize()
+		for _, state := range mS.states[1:] {
+			maxPayloadSize = min(maxPayloadSize, state.packetSerializer.MaxPayloadSize())
+		}
+		return maxPayloadSize
+	}
+
+	state := c.sendState.Load()
+	if state == nil {
+		return 0
+	}
+	return state.packetSerializer.MaxPayloadSize()
+}
+
+// Path returns the path the connection currently sends on, nil if it has no remote address.
+// In multipath mode, this is the first of the paths returned by Paths.
+func (c *OptimizedSCIONConn) Path() snet.Path {
+	state := c.sendState.Load()
+	if state == nil {
+		return nil
+	}
+	return state.path
+}
+
+// Paths returns all paths the connection currently sends on.
+func (c *OptimizedSCIONConn) Paths() []snet.Path {
+	if mS := c.multipath.Load(); mS != nil {
+		return append([]snet.Path(nil), mS.paths...)
+	}
+	if path := c.Path(); path != nil {
+		return []snet.Path{path}
+	}
+	return nil
+}
+
+// PathMetadata returns a copy of the metadata (hops, interfaces, MTU, latency, bandwidth,
+// expiry, geo, link types, notes) of the current path. It returns nil if the path was
+// not looked up from the daemon or set with SetPath, since addresses carry no metadata.
+func (c *OptimizedSCIONConn) PathMetadata() *snet.PathMetadata {
+	path := c.Path()
+	if path == nil {
+		return nil
+	}
+	return path.Metadata().Copy()
+}
+
 func (c *OptimizedSCIONConn) LocalAddr() net.Addr {
 	return c.listenAddr
 }
 
 func (c *OptimizedSCIONConn) RemoteAddr() net.Addr {
-	return c.remoteAddr
+	state := c.sendState.Load()
+	if state == nil {
+		return nil
+	}
+	return state.remoteAddr
 }
 
 func (c *OptimizedSCIONConn) SetDeadline(t time.Time) error {
@@ -300,3 +554,11 @@ func (c *OptimizedSCIONConn) SetReadDeadline(t time.Time) error {
 func (c *OptimizedSCIONConn) SetWriteDeadline(t time.Time) error {
 	return c.transportConn.SetWriteDeadline(t)
 }
+
+// listenNetwork returns the UDP network matching the address family of listenAddr.
+func listenNetwork(listenAddr *net.UDPAddr) string {
+	if listenAddr.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
@@ -2,27 +2,136 @@ package optimizedconn
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/scionproto/scion/pkg/addr"
 	"github.com/scionproto/scion/pkg/daemon"
 	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
 )
 
 // Took from appnet and modified a bit.
 
+// ConnectivityContext holds the daemon connection and local AS information used by connections.
+// One ConnectivityContext can be shared by many connections via WithConnectivityContext.
+// Every connection holds a reference to it, the daemon connection is closed once the
+// ConnectivityContext itself and all connections using it are closed.
 type ConnectivityContext struct {
+	// DaemonConn is the daemon connection. With MonitorDaemon, it is replaced by a new
+	// connection if the daemon fails, use Daemon to read it while the monitor runs.
 	DaemonConn daemon.Connector
 	// Dispatcher reliable.Dispatcher
 	LocalIA addr.IA
+	// LocalMTU is the MTU of the local AS, used whenever a path does not carry metadata.
+	LocalMTU uint16
+
+	// mtx guards refs, closed and, while MonitorDaemon runs, DaemonConn.
+	mtx    sync.Mutex
+	refs   int
+	closed bool
+
+	// connect opens a new daemon connection, if the ConnectivityContext knows how to.
+	connect func(ctx context.Context) (daemon.Connector, error)
+	monitor atomic.Pointer[daemonMonitor]
+
+	nextHops nextHopResolver
 }
 
+// Close releases the caller's reference to the ConnectivityContext. No new connections can use it
+// afterwards, the daemon connection is closed once the last connection using it is closed.
+// Close can be called multiple times.
+func (cC *ConnectivityContext) Close() error {
+	cC.mtx.Lock()
+	if cC.closed {
+		cC.mtx.Unlock()
+		return nil
+	}
+	cC.closed = true
+	refs := cC.refs
+	cC.mtx.Unlock()
+
+	if refs == 0 {
+		return cC.closeDaemonConn()
+	}
+	return nil
+}
+
+// retain adds a reference for a connection using the ConnectivityContext.
+func (cC *ConnectivityContext) retain() error {
+	cC.mtx.Lock()
+	defer cC.mtx.Unlock()
+	if cC.closed {
+		return ErrConnectivityContextClosed
+	}
+	cC.refs++
+	return nil
+}
+
+// release drops a reference added by retain and closes the daemon connection if it was the last
+// one of a closed ConnectivityContext.
+func (cC *ConnectivityContext) release() error {
+	cC.mtx.Lock()
+	cC.refs--
+	last := cC.refs == 0 && cC.closed
+	cC.mtx.Unlock()
+
+	if last {
+		return cC.closeDaemonConn()
+	}
+	return nil
+}
+
+func (cC *ConnectivityContext) closeDaemonConn() error {
+	if m := cC.monitor.Load(); m != nil {
+		m.stop()
+	}
+	daemonConn := cC.Daemon()
+	if daemonConn == nil {
+		return nil
+	}
+	return daemonConn.Close()
+}
+
+// acquireConnectivityContext returns shared with an added reference. Without a shared
+// ConnectivityContext, a new one is prepared that is owned by the calling connection alone.
+func acquireConnectivityContext(ctx context.Context, shared *ConnectivityContext) (*ConnectivityContext, error) {
+	if shared != nil {
+		if err := shared.retain(); err != nil {
+			return nil, err
+		}
+		return shared, nil
+	}
+
+	cC, err := PrepareConnectivityContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The daemon connection is closed together with the connection.
+	cC.retain()
+	cC.Close()
+	return cC, nil
+}
+
+// daemonError wraps err, returned by the daemon request op, into a DaemonError. The gRPC errors
+// of the daemon do not wrap the errors of ctx, so they are added if ctx is done.
+func daemonError(ctx context.Context, op string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		err = fmt.Errorf("%w: %w", ctxErr, err)
+	}
+	return &DaemonError{Op: op, Err: err}
+}
+
+// PrepareConnectivityContext connects to the SCION daemon and looks up the local AS.
+// ctx bounds the connection attempt and the lookups. Failures are returned as DaemonError.
 func PrepareConnectivityContext(ctx context.Context) (*ConnectivityContext, error) {
 
 	daemonConn, err := findSciond(ctx)
 	if err != nil {
-		return nil, err
+		return nil, daemonError(ctx, "connect", err)
 	}
 
 	/*dispatcher, err := findDispatcher()
@@ -30,19 +139,39 @@ func PrepareConnectivityContext(ctx context.Context) (*ConnectivityContext, erro
 		return nil, err
 	}*/
 
-	localIA, err := daemonConn.LocalIA(ctx)
+	cC, err := NewConnectivityContext(ctx, daemonConn)
 	if err != nil {
 		return nil, err
 	}
+	cC.connect = findSciond
+	return cC, nil
+}
+
+// NewConnectivityContext creates a ConnectivityContext using daemonConn, e.g. an optimizedconntest.FakeDaemon in tests
+// or a connection to a daemon at a custom address. The local AS is looked up from daemonConn.
+// The ConnectivityContext takes ownership of daemonConn and closes it when it is no longer used.
+func NewConnectivityContext(ctx context.Context, daemonConn daemon.Connector) (*ConnectivityContext, error) {
+
+	localIA, err := daemonConn.LocalIA(ctx)
+	if err != nil {
+		daemonConn.Close()
+		return nil, daemonError(ctx, "local IA", err)
+	}
+
+	asInfo, err := daemonConn.ASInfo(ctx, localIA)
+	if err != nil {
+		daemonConn.Close()
+		return nil, daemonError(ctx, "AS info", err)
+	}
 
 	cContext := ConnectivityContext{
 		DaemonConn: daemonConn,
 		// Dispatcher: dispatcher,
-		LocalIA: localIA,
+		LocalIA:  localIA,
+		LocalMTU: asInfo.MTU,
 	}
 
 	return &cContext, nil
-
 }
 
 // Parts of this file were took from the scion-apps repository.
@@ -117,18 +246,60 @@ func queryPaths(sciond daemon.Connector, ctx context.Context, dst *snet.UDPAddr)
 	return snetPaths, err
 }
 
-func setDefaultPath(sciond daemon.Connector, ctx context.Context, dst *snet.UDPAddr) error {
-	paths, err := queryPaths(sciond, ctx, dst)
+// pathMTU returns the MTU announced for path, falling back to the MTU of the local AS.
+func (cC *ConnectivityContext) pathMTU(path snet.Path) int {
+	if path != nil {
+		if metadata := path.Metadata(); metadata != nil && metadata.MTU > 0 {
+			return int(metadata.MTU)
+		}
+	}
+	return int(cC.LocalMTU)
+}
+
+// resolvePath makes sure dst carries a path. If dst has no path, an empty path is used within the
+// local AS and otherwise a path is looked up from the daemon, filtered by the path policy and
+// picked by the path selector of options.
+// The returned snet.Path carries the path metadata, if it was looked up.
+func (cC *ConnectivityContext) resolvePath(ctx context.Context, dst *snet.UDPAddr, options *connOptions) (snet.Path, error) {
+	if dst.Path != nil {
+		return dst.GetPath()
+	}
+
+	if cC.LocalIA.Equal(dst.IA) {
+		dst.Path = snetpath.Empty{}
+		return dst.GetPath()
+	}
+
+	paths, err := cC.resolvePaths(ctx, dst, options)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if len(paths) > 0 {
-		dst.Path = paths[0].Dataplane()
-		dst.NextHop = paths[0].UnderlayNextHop()
-		return nil
+
+	path := options.pathSelector.Select(dst, paths)
+	dst.Path = dataplanePath(path)
+	return path, nil
+}
+
+// resolvePaths looks up the paths to dst from the daemon and applies the path policy of options.
+// It returns an error wrapping ErrNoPath instead of an empty result.
+func (cC *ConnectivityContext) resolvePaths(ctx context.Context, dst *snet.UDPAddr, options *connOptions) ([]snet.Path, error) {
+	paths, err := cC.paths(ctx, dst)
+	if err != nil {
+		return nil, daemonError(ctx, "paths", err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoPath, dst.IA)
 	}
 
-	// return errors.New("No path2 found")
-	return nil
+	if options.pathPolicy != nil {
+		paths = options.pathPolicy.Apply(paths)
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("%w: %s, no path matches the path policy", ErrNoPath, dst.IA)
+		}
+	}
 
+	if options.failover != nil {
+		paths = options.failover.filter(paths)
+	}
+	return paths, nil
 }
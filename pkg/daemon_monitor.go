@@ -0,0 +1,267 @@
+package optimizedconn
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+const (
+	defaultDaemonCheckInterval = 10 * time.Second
+	defaultDaemonCheckTimeout  = 5 * time.Second
+	defaultDaemonMinBackoff    = time.Second
+	defaultDaemonMaxBackoff    = time.Minute
+)
+
+// DaemonMonitorConfig configures the health monitoring of the daemon connection of a ConnectivityContext.
+type DaemonMonitorConfig struct {
+	// Interval between two health checks while the daemon is healthy. Defaults to 10 seconds.
+	// A failed path lookup triggers a check immediately.
+	Interval time.Duration
+	// Timeout of a health check or reconnection attempt. Defaults to 5 seconds.
+	Timeout time.Duration
+	// MinBackoff is the delay before the first reconnection attempt, it doubles with every
+	// failed attempt up to MaxBackoff. Defaults to one second and one minute.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Connect opens a new daemon connection if the current one is broken. Defaults to connecting to
+	// SCION_DAEMON_ADDRESS for contexts created by PrepareConnectivityContext. Without Connect,
+	// the current connection is checked until it recovers.
+	Connect func(ctx context.Context) (daemon.Connector, error)
+	// OnStatusChange is called whenever the daemon becomes unhealthy or healthy again.
+	OnStatusChange func(status DaemonStatus)
+}
+
+// DaemonStatus describes the health of the daemon connection of a ConnectivityContext.
+type DaemonStatus struct {
+	// Healthy is false while path lookups are expected to fail.
+	Healthy bool
+	// Since is when Healthy last changed.
+	Since time.Time
+	// LastError is the most recent failure of the daemon, it is kept after recovery.
+	LastError error
+	// Reconnects counts how often the daemon connection was replaced.
+	Reconnects int
+}
+
+// MonitorDaemon starts checking the health of the daemon connection in the background. If the daemon
+// fails, for example because it restarted, it is reconnected with exponential backoff and path
+// lookups use the new connection transparently. Changes are reported via
+// DaemonMonitorConfig.OnStatusChange and DaemonStatus. Monitoring stops when the
+// ConnectivityContext is closed.
+func (cC *ConnectivityContext) MonitorDaemon(config DaemonMonitorConfig) error {
+	if config.Interval <= 0 {
+		config.Interval = defaultDaemonCheckInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultDaemonCheckTimeout
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaultDaemonMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = max(defaultDaemonMaxBackoff, config.MinBackoff)
+	}
+	if config.Connect == nil {
+		config.Connect = cC.connect
+	}
+
+	cC.mtx.Lock()
+	defer cC.mtx.Unlock()
+	if cC.closed && cC.refs == 0 {
+		return ErrConnectivityContextClosed
+	}
+	if cC.monitor.Load() != nil {
+		return ErrDaemonMonitored
+	}
+
+	m := &daemonMonitor{
+		config:   config,
+		cC:       cC,
+		status:   DaemonStatus{Healthy: true, Since: time.Now()},
+		failed:   make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+	}
+	cC.monitor.Store(m)
+	go m.run()
+	return nil
+}
+
+// DaemonStatus returns the health of the daemon connection. Without MonitorDaemon,
+// the daemon is always reported healthy.
+func (cC *ConnectivityContext) DaemonStatus() DaemonStatus {
+	if m := cC.monitor.Load(); m != nil {
+		return m.getStatus()
+	}
+	return DaemonStatus{Healthy: true}
+}
+
+// Daemon returns the current daemon connection. Unlike reading DaemonConn, it is safe
+// while MonitorDaemon may replace the connection.
+func (cC *ConnectivityContext) Daemon() daemon.Connector {
+	cC.mtx.Lock()
+	defer cC.mtx.Unlock()
+	return cC.DaemonConn
+}
+
+// paths queries the current daemon connection for paths to dst and reports failures to the monitor.
+func (cC *ConnectivityContext) paths(ctx context.Context, dst *snet.UDPAddr) ([]snet.Path, error) {
+	paths, err := queryPaths(cC.Daemon(), ctx, dst)
+	// Failures caused by the deadline of the caller say nothing about the daemon.
+	if err != nil && ctx.Err() == nil {
+		if m := cC.monitor.Load(); m != nil {
+			m.reportFailure()
+		}
+	}
+	return paths, err
+}
+
+type daemonMonitor struct {
+	config DaemonMonitorConfig
+	// cC holds the daemon connection, which the monitor replaces under cC.mtx.
+	cC *ConnectivityContext
+
+	mtx    sync.Mutex
+	status DaemonStatus
+	// stopped is guarded by cC.mtx, so that no connection is swapped in after the
+	// ConnectivityContext closed the current one.
+	stopped bool
+
+	failed   chan struct{}
+	stopOnce sync.Once
+	stopChan chan struct{}
+}
+
+func (m *daemonMonitor) getStatus() DaemonStatus {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.status
+}
+
+// reportFailure triggers a health check without waiting for the next interval.
+func (m *daemonMonitor) reportFailure() {
+	select {
+	case m.failed <- struct{}{}:
+	default:
+	}
+}
+
+func (m *daemonMonitor) run() {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopChan:
+			return
+		case <-ticker.C:
+		case <-m.failed:
+		}
+
+		err := m.check()
+		m.setStatus(err)
+		if err != nil {
+			m.recover()
+		}
+	}
+}
+
+// check asks the current daemon connection for the local AS.
+func (m *daemonMonitor) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.Timeout)
+	defer cancel()
+	_, err := m.cC.Daemon().LocalIA(ctx)
+	if err != nil {
+		return daemonError(ctx, "health check", err)
+	}
+	return nil
+}
+
+// recover retries with exponential backoff until the daemon is healthy again or the monitor is stopped.
+func (m *daemonMonitor) recover() {
+	backoff := m.config.MinBackoff
+	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-m.stopChan:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := m.reconnect()
+		m.setStatus(err)
+		if err == nil {
+			return
+		}
+		backoff = min(2*backoff, m.config.MaxBackoff)
+	}
+}
+
+// reconnect replaces the current daemon connection, unless it recovered on its own.
+func (m *daemonMonitor) reconnect() error {
+	err := m.check()
+	if err == nil || m.config.Connect == nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.Timeout)
+	defer cancel()
+	conn, err := m.config.Connect(ctx)
+	if err != nil {
+		return daemonError(ctx, "connect", err)
+	}
+	if _, err := conn.LocalIA(ctx); err != nil {
+		conn.Close()
+		return daemonError(ctx, "local IA", err)
+	}
+
+	m.cC.mtx.Lock()
+	if m.stopped {
+		m.cC.mtx.Unlock()
+		return conn.Close()
+	}
+	old := m.cC.DaemonConn
+	m.cC.DaemonConn = conn
+	m.cC.mtx.Unlock()
+
+	m.mtx.Lock()
+	m.status.Reconnects++
+	m.mtx.Unlock()
+
+	old.Close()
+	return nil
+}
+
+// setStatus records the result of a check and reports changes of the health.
+func (m *daemonMonitor) setStatus(err error) {
+	m.mtx.Lock()
+	healthy := err == nil
+	changed := healthy != m.status.Healthy
+	if err != nil {
+		m.status.LastError = err
+	}
+	if changed {
+		m.status.Healthy = healthy
+		m.status.Since = time.Now()
+	}
+	status := m.status
+	m.mtx.Unlock()
+
+	if changed && m.config.OnStatusChange != nil {
+		m.config.OnStatusChange(status)
+	}
+}
+
+// stop ends the monitoring. Afterwards, the daemon connection is not replaced anymore.
+func (m *daemonMonitor) stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopChan)
+	})
+	m.cC.mtx.Lock()
+	defer m.cC.mtx.Unlock()
+	m.stopped = true
+}
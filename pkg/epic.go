@@ -0,0 +1,120 @@
+package optimizedconn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	libepic "github.com/scionproto/scion/pkg/experimental/epic"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/slayers"
+	"github.com/scionproto/scion/pkg/slayers/path/epic"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+// NewEPICPath converts a path announced with EPIC authenticators into an EPIC-HP dataplane path.
+// The result can be set as Path of the remote address passed to Dial or WriteTo. Paths looked up
+// by the connections or passed to SetPath and WriteToVia are converted automatically.
+func NewEPICPath(path snet.Path) (snet.DataplanePath, error) {
+	metadata := path.Metadata()
+	if metadata == nil || !metadata.EpicAuths.SupportsEpic() {
+		return nil, serrors.New("path does not support EPIC")
+	}
+	scionPath, ok := path.Dataplane().(snetpath.SCION)
+	if !ok {
+		return nil, serrors.New("EPIC requires a SCION dataplane path", "type", path.Dataplane())
+	}
+	return snetpath.NewEPICDataplanePath(scionPath, metadata.EpicAuths)
+}
+
+// dataplanePath returns the dataplane path packets over path are sent with. Paths announced with
+// EPIC authenticators are sent as EPIC-HP paths, all others with their regular dataplane path.
+func dataplanePath(path snet.Path) snet.DataplanePath {
+	if epicPath, err := NewEPICPath(path); err == nil {
+		return epicPath
+	}
+	return path.Dataplane()
+}
+
+// epicState holds everything needed to refresh the EPIC packet ID and hop validation fields
+// of a prepared packet. Unlike the SCION path type, EPIC requires new values for each packet.
+type epicState struct {
+	// mtx guards the counter and the MAC input, which are shared by concurrent writers.
+	mtx sync.Mutex
+
+	authPHVF []byte
+	authLHVF []byte
+
+	// infoTimestamp is the timestamp of the first info field, the EPIC timestamp is relative to it.
+	infoTimestamp uint32
+	counter       uint32
+	// pathOffset is the position of the EPIC path header within the packet.
+	pathOffset int
+
+	// scionLayer contains the header fields that are part of the MAC input.
+	scionLayer slayers.SCION
+	macBuffer  []byte
+}
+
+func newEPICState(epicPath *snetpath.EPIC, localIA addr.IA, source addr.Host, destination addr.Host) (*epicState, error) {
+	var sp scion.Raw
+	if err := sp.DecodeFromBytes(epicPath.SCION); err != nil {
+		return nil, err
+	}
+	info, err := sp.GetInfoField(0)
+	if err != nil {
+		return nil, err
+	}
+
+	eS := epicState{
+		authPHVF:      append([]byte(nil), epicPath.AuthPHVF...),
+		authLHVF:      append([]byte(nil), epicPath.AuthLHVF...),
+		infoTimestamp: info.Timestamp,
+		macBuffer:     make([]byte, libepic.MACBufferSize),
+	}
+	eS.scionLayer.SrcIA = localIA
+	if err := eS.scionLayer.SetSrcAddr(source); err != nil {
+		return nil, err
+	}
+	if err := eS.scionLayer.SetDstAddr(destination); err != nil {
+		return nil, err
+	}
+	eS.pathOffset = slayers.CmnHdrLen + eS.scionLayer.AddrHdrLen()
+
+	return &eS, nil
+}
+
+// update writes a fresh packet ID and the matching PHVF and LHVF into packet.
+func (eS *epicState) update(packet []byte, payloadLen uint16) error {
+	timestamp, err := libepic.CreateTimestamp(time.Unix(int64(eS.infoTimestamp), 0), time.Now())
+	if err != nil {
+		return err
+	}
+	eS.mtx.Lock()
+	defer eS.mtx.Unlock()
+
+	eS.counter++
+	pktID := epic.PktID{
+		Timestamp: timestamp,
+		Counter:   eS.counter,
+	}
+	eS.scionLayer.PayloadLen = payloadLen
+
+	path := packet[eS.pathOffset : eS.pathOffset+epic.MetadataLen]
+	pktID.SerializeTo(path[:epic.PktIDLen])
+
+	phvf, err := libepic.CalcMac(eS.authPHVF, pktID, &eS.scionLayer, eS.infoTimestamp, eS.macBuffer)
+	if err != nil {
+		return err
+	}
+	copy(path[epic.PktIDLen:epic.PktIDLen+epic.HVFLen], phvf[:epic.HVFLen])
+
+	lhvf, err := libepic.CalcMac(eS.authLHVF, pktID, &eS.scionLayer, eS.infoTimestamp, eS.macBuffer)
+	if err != nil {
+		return err
+	}
+	copy(path[epic.PktIDLen+epic.HVFLen:epic.MetadataLen], lhvf[:epic.HVFLen])
+	return nil
+}
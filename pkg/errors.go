@@ -0,0 +1,208 @@
+package optimizedconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/google/gopacket"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/slayers"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// Errors returned by the connections of this package. Most of them are wrapped with details,
+// check for them with errors.Is.
+var (
+	// ErrNotConnected is returned when sending on a connection that has no remote address yet.
+	ErrNotConnected = errors.New("connection has no remote address")
+	// ErrUnknownNextHeader is wrapped by UnknownNextHeaderError.
+	ErrUnknownNextHeader = errors.New("unknown next header")
+	// ErrTruncatedPacket is returned for received packets that are shorter than their headers.
+	ErrTruncatedPacket = errors.New("truncated packet")
+	// ErrNilPath is returned by SetPath for a nil path.
+	ErrNilPath = errors.New("path is nil")
+	// ErrPathExpired is returned when sending over a path whose hop fields have expired.
+	ErrPathExpired = errors.New("path expired")
+	// ErrNoPath is returned if the daemon does not know any path to the remote AS.
+	ErrNoPath = errors.New("no path to remote AS")
+	// ErrNoNextHop is returned if the border router a path leaves the local AS through is unknown.
+	ErrNoNextHop = errors.New("no next hop")
+	// ErrPathDown is wrapped by the Reason of a FailoverEvent.
+	ErrPathDown = errors.New("path down")
+	// ErrMessageTooBig is wrapped by MessageTooBigError.
+	ErrMessageTooBig = errors.New("message too big")
+	// ErrConnectivityContextClosed is returned when a closed ConnectivityContext is passed to a new connection.
+	ErrConnectivityContextClosed = errors.New("connectivity context is closed")
+	// ErrDaemonMonitored is returned if MonitorDaemon is called twice on the same ConnectivityContext.
+	ErrDaemonMonitored = errors.New("daemon is already monitored")
+	// ErrUnspecifiedListenAddr is returned if a connection is opened on a missing or unspecified listen address.
+	ErrUnspecifiedListenAddr = errors.New("listen address is unspecified")
+	// ErrUnsupportedAddr is returned for addresses of a type the connection cannot send to.
+	ErrUnsupportedAddr = errors.New("unsupported address type")
+	// ErrNotIPHost is returned for SCION addresses whose host is not an IP address, e.g. a service address.
+	ErrNotIPHost = errors.New("host is not an IP address")
+	// ErrUnsupportedPath is returned by Read of listening connections if the path of the first packet
+	// cannot be reversed.
+	ErrUnsupportedPath = errors.New("unsupported path type")
+)
+
+// DaemonError is returned if a request to the SCION daemon fails. If the request was aborted
+// because ctx was canceled or its deadline passed, Err wraps the error of the context,
+// which can be checked with Timeout or errors.Is.
+type DaemonError struct {
+	// Op is the daemon request that failed, e.g. "connect", "local IA" or "paths".
+	Op  string
+	Err error
+}
+
+func (e *DaemonError) Error() string {
+	return fmt.Sprintf("SCION daemon %s: %v", e.Op, e.Err)
+}
+
+func (e *DaemonError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the request was aborted because the deadline of its context passed.
+func (e *DaemonError) Timeout() bool {
+	return errors.Is(e.Err, context.DeadlineExceeded)
+}
+
+// MessageTooBigError is returned if a payload does not fit into a single packet on the path.
+type MessageTooBigError struct {
+	PayloadSize    int
+	MaxPayloadSize int
+}
+
+func (e *MessageTooBigError) Error() string {
+	return fmt.Sprintf("message too big: payload of %d bytes exceeds maximum of %d bytes", e.PayloadSize, e.MaxPayloadSize)
+}
+
+func (e *MessageTooBigError) Unwrap() error {
+	return ErrMessageTooBig
+}
+
+// UnknownNextHeaderError is returned for received packets that carry neither UDP nor an SCMP message
+// handled by the connection.
+type UnknownNextHeaderError struct {
+	NextHeader uint8
+}
+
+func (e *UnknownNextHeaderError) Error() string {
+	return fmt.Sprintf("unknown next header %d", e.NextHeader)
+}
+
+func (e *UnknownNextHeaderError) Unwrap() error {
+	return ErrUnknownNextHeader
+}
+
+// UnexpectedSourceError is returned by Read of connections with SourceReject for a packet
+// from a source other than the remote.
+type UnexpectedSourceError struct {
+	Source snet.SCIONAddress
+	Port   uint16
+}
+
+func (e *UnexpectedSourceError) Error() string {
+	return fmt.Sprintf("packet from unexpected source %s:%d", e.Source, e.Port)
+}
+
+// SCMPError is an SCMP error message a connection received in response to one of its packets.
+// It wraps ErrPathDown if the message reports the path as broken.
+type SCMPError struct {
+	TypeCode slayers.SCMPTypeCode
+	// Source is the sender of the message, usually a border router on the path.
+	Source snet.SCIONAddress
+	// Detail describes the failure, e.g. the interface that is down.
+	Detail string
+	err    error
+}
+
+func (e *SCMPError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("SCMP %s from %s", e.TypeCode, e.Source)
+	}
+	return fmt.Sprintf("SCMP %s from %s: %s", e.TypeCode, e.Source, e.Detail)
+}
+
+func (e *SCMPError) Unwrap() error {
+	return e.err
+}
+
+// newSCMPError converts an SCMP error message into an SCMPError. It returns nil for informational
+// messages and for payloads that are not SCMP.
+func newSCMPError(pkt *snet.Packet) *SCMPError {
+	msg, ok := pkt.Payload.(snet.SCMPPayload)
+	if !ok {
+		return nil
+	}
+	sE := SCMPError{
+		TypeCode: slayers.CreateSCMPTypeCode(msg.Type(), msg.Code()),
+		Source:   pkt.Source,
+	}
+	if sE.TypeCode.InfoMsg() {
+		return nil
+	}
+	switch msg := msg.(type) {
+	case snet.SCMPExternalInterfaceDown:
+		sE.Detail = fmt.Sprintf("interface %s#%d is down", msg.IA, msg.Interface)
+		sE.err = ErrPathDown
+	case snet.SCMPInternalConnectivityDown:
+		sE.Detail = fmt.Sprintf("connectivity between interfaces %d and %d in %s is down", msg.Ingress, msg.Egress, msg.IA)
+		sE.err = ErrPathDown
+	case snet.SCMPDestinationUnreachable:
+		sE.Detail = "destination unreachable"
+		sE.err = ErrPathDown
+	}
+	return &sE
+}
+
+// scmpQuote returns the packet quoted by an SCMP error message, nil for other payloads.
+func scmpQuote(payload snet.Payload) []byte {
+	switch msg := payload.(type) {
+	case snet.SCMPDestinationUnreachable:
+		return msg.Payload
+	case snet.SCMPPacketTooBig:
+		return msg.Payload
+	case snet.SCMPParameterProblem:
+		return msg.Payload
+	case snet.SCMPExternalInterfaceDown:
+		return msg.Payload
+	case snet.SCMPInternalConnectivityDown:
+		return msg.Payload
+	}
+	return nil
+}
+
+// quotesPacketTo reports whether the SCMP error message pkt quotes a UDP packet sent from
+// the port localPort in localIA to remoteAddr. If remoteAddr is nil, packets to any destination match.
+func quotesPacketTo(pkt *snet.Packet, localIA addr.IA, localPort uint16, remoteAddr *snet.UDPAddr) bool {
+	quote := scmpQuote(pkt.Payload)
+	if quote == nil {
+		return false
+	}
+	var scionLayer slayers.SCION
+	if err := scionLayer.DecodeFromBytes(quote, gopacket.NilDecodeFeedback); err != nil {
+		return false
+	}
+	var udp slayers.UDP
+	if scionLayer.NextHdr != slayers.L4UDP || udp.DecodeFromBytes(scionLayer.Payload, gopacket.NilDecodeFeedback) != nil {
+		return false
+	}
+	if !scionLayer.SrcIA.Equal(localIA) || udp.SrcPort != localPort {
+		return false
+	}
+	if remoteAddr == nil {
+		return true
+	}
+
+	dst, err := scionLayer.DstAddr()
+	if err != nil || dst.Type() != addr.HostTypeIP {
+		return false
+	}
+	remoteIP, ok := netip.AddrFromSlice(remoteAddr.Host.IP)
+	return ok && scionLayer.DstIA.Equal(remoteAddr.IA) && dst.IP() == remoteIP.Unmap() &&
+		int(udp.DstPort) == remoteAddr.Host.Port
+}
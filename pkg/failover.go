@@ -0,0 +1,344 @@
+package optimizedconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/scionproto/scion/pkg/segment/iface"
+	"github.com/scionproto/scion/pkg/slayers"
+	slayerspath "github.com/scionproto/scion/pkg/slayers/path"
+	"github.com/scionproto/scion/pkg/slayers/path/epic"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// FailoverConfig configures how connections move away from broken paths.
+type FailoverConfig struct {
+	// LossThreshold is the number of consecutive missing probe replies after which
+	// a path is considered down. Defaults to 3.
+	LossThreshold int
+	// HoldDown is how long a path or interface that was reported down is not used again.
+	// Defaults to 30 seconds.
+	HoldDown time.Duration
+	// MinSwitchInterval is the minimum time between two path switches of a connection,
+	// to avoid flapping between paths. A switch within the interval is postponed until
+	// it ended. Defaults to one second. It only applies to connections created by Dial,
+	// an OptimizedSCIONPacketConn switches the path of a destination with the next write to it.
+	MinSwitchInterval time.Duration
+	// OnSwitch is called after a connection switched to another path.
+	OnSwitch func(event FailoverEvent)
+}
+
+// FailoverEvent describes a path switch.
+type FailoverEvent struct {
+	RemoteAddr *snet.UDPAddr
+	From       snet.Path
+	To         snet.Path
+	// Reason is the failure that caused the switch. It wraps ErrPathDown, for SCMP messages it is an SCMPError.
+	Reason error
+}
+
+// failoverManager keeps track of paths and interfaces reported down and filters them
+// out of path lookups until their hold down expired.
+type failoverManager struct {
+	config FailoverConfig
+
+	mtx            sync.Mutex
+	downInterfaces map[snet.PathInterface]time.Time
+	downPaths      map[PathFingerprint]time.Time
+	probeLosses    map[PathFingerprint]int
+	lastSwitch     time.Time
+	switching      bool
+	// retrying is set while a postponed switch is scheduled.
+	retrying bool
+}
+
+func newFailoverManager(config FailoverConfig) *failoverManager {
+	if config.LossThreshold <= 0 {
+		config.LossThreshold = 3
+	}
+	if config.HoldDown <= 0 {
+		config.HoldDown = 30 * time.Second
+	}
+	if config.MinSwitchInterval <= 0 {
+		config.MinSwitchInterval = time.Second
+	}
+	return &failoverManager{
+		config:         config,
+		downInterfaces: make(map[snet.PathInterface]time.Time),
+		downPaths:      make(map[PathFingerprint]time.Time),
+		probeLosses:    make(map[PathFingerprint]int),
+	}
+}
+
+// handleSCMP records the interfaces reported down by an SCMP error. It returns the SCMPError,
+// if the message is an error that makes paths unusable, and nil otherwise.
+func (fM *failoverManager) handleSCMP(pkt *snet.Packet) error {
+	sE := newSCMPError(pkt)
+	if sE == nil || !errors.Is(sE, ErrPathDown) {
+		return nil
+	}
+
+	fM.mtx.Lock()
+	defer fM.mtx.Unlock()
+
+	until := time.Now().Add(fM.config.HoldDown)
+	switch msg := pkt.Payload.(type) {
+	case snet.SCMPExternalInterfaceDown:
+		fM.downInterfaces[snet.PathInterface{IA: msg.IA, ID: iface.ID(msg.Interface)}] = until
+	case snet.SCMPInternalConnectivityDown:
+		fM.downInterfaces[snet.PathInterface{IA: msg.IA, ID: iface.ID(msg.Ingress)}] = until
+		fM.downInterfaces[snet.PathInterface{IA: msg.IA, ID: iface.ID(msg.Egress)}] = until
+	}
+	return sE
+}
+
+// markPathDown excludes path from future lookups until its hold down expired.
+func (fM *failoverManager) markPathDown(path snet.Path) {
+	fM.mtx.Lock()
+	defer fM.mtx.Unlock()
+	fM.downPaths[Fingerprint(path)] = time.Now().Add(fM.config.HoldDown)
+}
+
+// reportProbe records the outcome of a probe over path. It returns true if the path
+// just reached the loss threshold and was marked down.
+func (fM *failoverManager) reportProbe(path snet.Path, replied bool) bool {
+	fM.mtx.Lock()
+	defer fM.mtx.Unlock()
+
+	key := Fingerprint(path)
+	if replied {
+		delete(fM.probeLosses, key)
+		return false
+	}
+	fM.probeLosses[key]++
+	if fM.probeLosses[key] < fM.config.LossThreshold {
+		return false
+	}
+	delete(fM.probeLosses, key)
+	fM.downPaths[key] = time.Now().Add(fM.config.HoldDown)
+	return true
+}
+
+// isDown returns whether path traverses an interface or is itself within its hold down.
+func (fM *failoverManager) isDown(path snet.Path) bool {
+	fM.mtx.Lock()
+	defer fM.mtx.Unlock()
+	return fM.isDownLocked(path, time.Now())
+}
+
+func (fM *failoverManager) isDownLocked(path snet.Path, now time.Time) bool {
+	key := Fingerprint(path)
+	if until, ok := fM.downPaths[key]; ok {
+		if now.Before(until) {
+			return true
+		}
+		delete(fM.downPaths, key)
+	}
+	if path.Metadata() == nil {
+		return false
+	}
+	for _, intf := range path.Metadata().Interfaces {
+		if until, ok := fM.downInterfaces[intf]; ok {
+			if now.Before(until) {
+				return true
+			}
+			delete(fM.downInterfaces, intf)
+		}
+	}
+	return false
+}
+
+// filter removes paths that are down. If all paths are down, they are returned unfiltered,
+// since trying a broken path is better than not sending at all.
+func (fM *failoverManager) filter(paths []snet.Path) []snet.Path {
+	fM.mtx.Lock()
+	defer fM.mtx.Unlock()
+
+	now := time.Now()
+	usable := make([]snet.Path, 0, len(paths))
+	for _, path := range paths {
+		if !fM.isDownLocked(path, now) {
+			usable = append(usable, path)
+		}
+	}
+	if len(usable) == 0 {
+		return paths
+	}
+	return usable
+}
+
+// beginSwitch returns true if the caller may switch paths now. Each successful call
+// must be followed by endSwitch. Otherwise, retry is scheduled for when the switch
+// is allowed, unless a retry is scheduled already.
+func (fM *failoverManager) beginSwitch(retry func()) bool {
+	fM.mtx.Lock()
+	defer fM.mtx.Unlock()
+
+	wait := fM.config.MinSwitchInterval - time.Since(fM.lastSwitch)
+	if !fM.switching && wait <= 0 {
+		fM.switching = true
+		return true
+	}
+	if fM.switching {
+		// The running switch may not have seen the latest failure.
+		wait = fM.config.MinSwitchInterval
+	}
+	if !fM.retrying {
+		fM.retrying = true
+		time.AfterFunc(wait, func() {
+			fM.mtx.Lock()
+			fM.retrying = false
+			fM.mtx.Unlock()
+			retry()
+		})
+	}
+	return false
+}
+
+func (fM *failoverManager) endSwitch(switched bool) {
+	fM.mtx.Lock()
+	defer fM.mtx.Unlock()
+	fM.switching = false
+	if switched {
+		fM.lastSwitch = time.Now()
+	}
+}
+
+// failover moves a dialed connection to another path, if its current path is down.
+// Connections whose path was not looked up by Dial or was pinned with SetPath keep their path.
+func (oSC *OptimizedSCIONConn) failover(reason error) {
+	fM := oSC.options.failover
+	if oSC.pathRefresher == nil || oSC.pathRefresher.stopped() || oSC.pinned.Load() {
+		return
+	}
+	if !fM.beginSwitch(func() { oSC.failover(reason) }) {
+		return
+	}
+	switched := false
+	defer func() { fM.endSwitch(switched) }()
+
+	ctx, cancel := context.WithTimeout(oSC.pathRefresher.ctx, pathQueryTimeout)
+	defer cancel()
+
+	// In multipath mode, all paths are looked up again as soon as one of them is down.
+	var down snet.Path
+	if mS := oSC.multipath.Load(); mS != nil {
+		for _, path := range mS.paths {
+			if fM.isDown(path) {
+				down = path
+				break
+			}
+		}
+	} else if path := oSC.sendState.Load().path; fM.isDown(path) {
+		down = path
+	}
+	if down == nil {
+		return
+	}
+
+	current, err := oSC.pathRefresher.refresh(ctx)
+	if err != nil {
+		return
+	}
+
+	switched = true
+	oSC.options.logger.Info("Switched path", "remote", current.remoteAddr, "from", down, "to", current.path, "reason", reason)
+	if fM.config.OnSwitch != nil {
+		fM.config.OnSwitch(FailoverEvent{
+			RemoteAddr: current.remoteAddr,
+			From:       down,
+			To:         current.path,
+			Reason:     reason,
+		})
+	}
+}
+
+// handleSCMP processes an SCMP message received by the connection.
+func (oSC *OptimizedSCIONConn) handleSCMP(pkt *snet.Packet) {
+	reason := oSC.options.failover.handleSCMP(pkt)
+	if reason == nil {
+		return
+	}
+	if msg, ok := pkt.Payload.(snet.SCMPDestinationUnreachable); ok {
+		var paths []snet.Path
+		if mS := oSC.multipath.Load(); mS != nil {
+			paths = mS.paths
+		} else if state := oSC.sendState.Load(); state != nil {
+			paths = []snet.Path{state.path}
+		}
+		if path := quotedPath(msg.Payload, paths); path != nil {
+			oSC.options.failover.markPathDown(path)
+		}
+	}
+	go oSC.failover(reason)
+}
+
+// quotedPath returns the path of paths the packet quoted by an SCMP error message was sent over,
+// nil if it cannot be identified. Routers update the path header while forwarding, so paths are
+// compared by their hop fields.
+func quotedPath(quote []byte, paths []snet.Path) snet.Path {
+	var scionLayer slayers.SCION
+	if err := scionLayer.DecodeFromBytes(quote, gopacket.NilDecodeFeedback); err != nil {
+		return nil
+	}
+	quotedHops, err := hopFields(scionLayer.Path)
+	if err != nil {
+		return nil
+	}
+	for _, path := range paths {
+		if path == nil {
+			continue
+		}
+		var pathLayer slayers.SCION
+		if err := path.Dataplane().SetPath(&pathLayer); err != nil {
+			continue
+		}
+		hops, err := hopFields(pathLayer.Path)
+		if err == nil && slices.EqualFunc(hops, quotedHops, sameHop) {
+			return path
+		}
+	}
+	return nil
+}
+
+// hopFields returns the hop fields of a SCION or EPIC path.
+func hopFields(p slayerspath.Path) ([]slayerspath.HopField, error) {
+	if epicPath, ok := p.(*epic.Path); ok {
+		p = epicPath.ScionPath
+	}
+	raw, ok := p.(*scion.Raw)
+	if !ok {
+		return nil, fmt.Errorf("unsupported path type %T", p)
+	}
+	hops := make([]slayerspath.HopField, raw.NumHops)
+	for i := range hops {
+		hop, err := raw.GetHopField(i)
+		if err != nil {
+			return nil, err
+		}
+		hops[i] = hop
+	}
+	return hops, nil
+}
+
+func sameHop(a, b slayerspath.HopField) bool {
+	return a.ConsIngress == b.ConsIngress && a.ConsEgress == b.ConsEgress && a.Mac == b.Mac
+}
+
+// ReportProbe records whether a probe sent over path was answered. After
+// FailoverConfig.LossThreshold consecutive losses, the path is considered down and the
+// connection fails over to another path. It has no effect without WithFailover.
+func (oSC *OptimizedSCIONConn) ReportProbe(path snet.Path, replied bool) {
+	if oSC.options.failover == nil {
+		return
+	}
+	if oSC.options.failover.reportProbe(path, replied) {
+		go oSC.failover(fmt.Errorf("%w: %d probes lost", ErrPathDown, oSC.options.failover.config.LossThreshold))
+	}
+}
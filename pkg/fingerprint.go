@@ -0,0 +1,132 @@
+package optimizedconn
+
+import (
+	"sync"
+
+	"github.com/scionproto/scion/pkg/private/common"
+	"github.com/scionproto/scion/pkg/slayers"
+	"github.com/scionproto/scion/pkg/slayers/path"
+	"github.com/scionproto/scion/pkg/slayers/path/empty"
+	"github.com/scionproto/scion/pkg/slayers/path/epic"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+// PathFingerprint identifies a path. Fingerprint derives it from the sequence of interfaces
+// the path crosses, so a refreshed path with new hop fields keeps its fingerprint.
+// DataplaneFingerprint derives it from the path type and the raw path bytes instead.
+type PathFingerprint uint64
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// Fingerprint returns the fingerprint of the interfaces path crosses, 0 for a nil path.
+// Paths without interfaces in their metadata, e.g. within the local AS or built from
+// a received packet, fall back to DataplaneFingerprint. It does not allocate for
+// paths returned by the daemon.
+func Fingerprint(path snet.Path) PathFingerprint {
+	switch p := path.(type) {
+	case nil:
+		return 0
+	case snetpath.Path:
+		// Metadata returns a copy, which is avoided for the paths of the daemon.
+		if len(p.Meta.Interfaces) > 0 {
+			return hashInterfaces(p.Meta.Interfaces)
+		}
+	case *snetpath.Path:
+		if len(p.Meta.Interfaces) > 0 {
+			return hashInterfaces(p.Meta.Interfaces)
+		}
+	default:
+		if meta := path.Metadata(); meta != nil && len(meta.Interfaces) > 0 {
+			return hashInterfaces(meta.Interfaces)
+		}
+	}
+	return DataplaneFingerprint(path.Dataplane())
+}
+
+// DataplaneFingerprint returns the fingerprint of dataplanePath, 0 for a nil path. Paths
+// have the same dataplane fingerprint if they have the same path type and raw path bytes,
+// so a refreshed path with new hop fields gets a new one. It does not allocate.
+func DataplaneFingerprint(dataplanePath snet.DataplanePath) PathFingerprint {
+	switch p := dataplanePath.(type) {
+	case nil:
+		return 0
+	case snetpath.Empty:
+		return hashPath(empty.PathType, nil)
+	case snetpath.SCION:
+		return hashPath(scion.PathType, p.Raw)
+	case *snetpath.EPIC:
+		// The EPIC fields are recomputed for every packet, the underlying SCION path identifies it.
+		return hashPath(epic.PathType, p.SCION)
+	case snet.RawPath:
+		return hashPath(p.PathType, p.Raw)
+	case snet.RawReplyPath:
+		if raw, ok := p.Path.(*scion.Raw); ok {
+			return hashPath(scion.PathType, raw.Raw)
+		}
+		return hashDecodedPath(p.Path)
+	default:
+		var scionLayer slayers.SCION
+		if err := dataplanePath.SetPath(&scionLayer); err != nil || scionLayer.Path == nil {
+			return 0
+		}
+		return hashDecodedPath(scionLayer.Path)
+	}
+}
+
+// decodedPathBuffers holds the buffers decoded paths are serialized into for hashing.
+var decodedPathBuffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, common.MaxMTU)
+		return &buffer
+	},
+}
+
+func hashDecodedPath(p path.Path) PathFingerprint {
+	buffer := decodedPathBuffers.Get().(*[]byte)
+	defer decodedPathBuffers.Put(buffer)
+
+	if len(*buffer) < p.Len() {
+		*buffer = make([]byte, p.Len())
+	}
+	raw := (*buffer)[:p.Len()]
+	if err := p.SerializeTo(raw); err != nil {
+		return 0
+	}
+	return hashPath(p.Type(), raw)
+}
+
+// hashInterfaces computes the FNV-1a hash of the IA and ID of every interface.
+func hashInterfaces(interfaces []snet.PathInterface) PathFingerprint {
+	h := uint64(fnvOffset64)
+	for _, intf := range interfaces {
+		h = hashUint64(h, uint64(intf.IA))
+		h = hashUint64(h, uint64(intf.ID))
+	}
+	return PathFingerprint(h)
+}
+
+func hashUint64(h, v uint64) uint64 {
+	for i := 0; i < 8; i++ {
+		h ^= v & 0xff
+		h *= fnvPrime64
+		v >>= 8
+	}
+	return h
+}
+
+// hashPath computes the FNV-1a hash of the path type followed by the raw path.
+func hashPath(pathType path.Type, raw []byte) PathFingerprint {
+	h := uint64(fnvOffset64)
+	h ^= uint64(pathType)
+	h *= fnvPrime64
+	for _, b := range raw {
+		h ^= uint64(b)
+		h *= fnvPrime64
+	}
+	return PathFingerprint(h)
+}
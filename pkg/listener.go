@@ -0,0 +1,409 @@
+package optimizedconn
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/private/common"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+const (
+	// listenerBacklog is the number of new peers waiting for Accept. Packets of further new peers are dropped.
+	listenerBacklog = 64
+	// peerQueueSize is the number of packets waiting for Read on one peer connection.
+	// Further packets are dropped, like with a full socket buffer.
+	peerQueueSize = 256
+)
+
+// Listener demultiplexes the packets arriving on one UDP socket by their SCION source
+// (ISD-AS, host and port) and hands out one connection per peer via Accept, like a
+// connected-UDP server. Replies are sent over the reversed path of the last packet
+// received from the peer.
+type Listener struct {
+	transportConn *net.UDPConn
+	listenAddr    *net.UDPAddr
+
+	connectivityContext *ConnectivityContext
+	replyPather         snet.ReplyPather
+	logger              *slog.Logger
+
+	mtx      sync.Mutex
+	peers    map[peerKey]*peerConn
+	closed   bool
+	acceptCh chan *peerConn
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+var _ net.Listener = &Listener{}
+
+// peerKey identifies a peer of a Listener by its SCION source address.
+type peerKey struct {
+	ia   addr.IA
+	host netip.AddrPort
+}
+
+// NewListener opens a Listener on listenAddr.
+func NewListener(listenAddr *net.UDPAddr, opts ...Option) (*Listener, error) {
+
+	if listenAddr == nil || listenAddr.IP == nil || listenAddr.IP.IsUnspecified() {
+		return nil, ErrUnspecifiedListenAddr
+	}
+
+	options := newConnOptions(opts)
+	connectivityContext, err := acquireConnectivityContext(context.Background(), options.connectivityContext)
+	if err != nil {
+		return nil, err
+	}
+
+	transportConn, err := net.ListenUDP(listenNetwork(listenAddr), listenAddr)
+	if err != nil {
+		connectivityContext.release()
+		return nil, err
+	}
+
+	l := &Listener{
+		transportConn:       transportConn,
+		listenAddr:          transportConn.LocalAddr().(*net.UDPAddr),
+		connectivityContext: connectivityContext,
+		replyPather:         snet.DefaultReplyPather{},
+		logger:              options.logger.With("local", transportConn.LocalAddr()),
+		peers:               make(map[peerKey]*peerConn),
+		acceptCh:            make(chan *peerConn, listenerBacklog),
+		closeChan:           make(chan struct{}),
+	}
+
+	go l.receive()
+
+	return l, nil
+}
+
+// Accept waits for a packet from a new peer and returns the connection to that peer.
+// The first packet can be read from the returned connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case peer := <-l.acceptCh:
+		return peer, nil
+	case <-l.closeChan:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the Listener and closes all connections accepted from it.
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+
+		l.mtx.Lock()
+		l.closed = true
+		peers := l.peers
+		l.peers = nil
+		l.mtx.Unlock()
+
+		for _, peer := range peers {
+			peer.closeOnce.Do(func() { close(peer.closeChan) })
+		}
+
+		err = l.transportConn.Close()
+		l.connectivityContext.release()
+	})
+	return err
+}
+
+// Addr returns the local address of the Listener.
+func (l *Listener) Addr() net.Addr {
+	return l.listenAddr
+}
+
+func (l *Listener) receive() {
+	buffer := make([]byte, common.MaxMTU)
+	for {
+		n, underlay, err := l.transportConn.ReadFrom(buffer)
+		if err != nil {
+			l.Close()
+			return
+		}
+
+		if n < 5 || buffer[4] != SCION_PROTOCOL_NUMBER_SCION_UDP {
+			continue
+		}
+		pkt := snet.Packet{
+			Bytes: snet.Bytes(buffer[:n]),
+		}
+		if err := pkt.Decode(); err != nil {
+			continue
+		}
+		udp, ok := pkt.Payload.(snet.UDPPayload)
+		if !ok {
+			continue
+		}
+		rawPath, ok := pkt.Path.(snet.RawPath)
+		if !ok || pkt.Source.Host.Type() != addr.HostTypeIP {
+			continue
+		}
+
+		key := peerKey{
+			ia:   pkt.Source.IA,
+			host: netip.AddrPortFrom(pkt.Source.Host.IP(), udp.SrcPort),
+		}
+		peer, isNew := l.peer(key)
+		if err := peer.update(rawPath, underlay.(*net.UDPAddr)); err != nil {
+			continue
+		}
+		if isNew && !l.register(peer) {
+			continue
+		}
+		peer.push(bytes.Clone(udp.Payload))
+	}
+}
+
+// peer returns the connection to the peer key. New connections are not yet known to the Listener,
+// they are registered once the reply path is prepared.
+func (l *Listener) peer(key peerKey) (*peerConn, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if peer, ok := l.peers[key]; ok {
+		return peer, false
+	}
+	return &peerConn{
+		listener:  l,
+		key:       key,
+		incoming:  make(chan []byte, peerQueueSize),
+		closeChan: make(chan struct{}),
+	}, true
+}
+
+// register queues peer for Accept. It returns false if the backlog is full or the Listener is closed.
+func (l *Listener) register(peer *peerConn) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		return false
+	}
+	select {
+	case l.acceptCh <- peer:
+		l.peers[peer.key] = peer
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Listener) removePeer(peer *peerConn) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.peers[peer.key] == peer {
+		delete(l.peers, peer.key)
+	}
+}
+
+// peerConn is the connection to one peer of a Listener.
+type peerConn struct {
+	listener *Listener
+	key      peerKey
+
+	sendState atomic.Pointer[sendState]
+	// rawPath and underlay are the path and underlay source of the last packet, the reply path is
+	// only rebuilt when they change. Both are only accessed by the receive loop of the listener.
+	rawPath  []byte
+	underlay *net.UDPAddr
+
+	incoming     chan []byte
+	readDeadline deadline
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+var _ net.Conn = &peerConn{}
+
+// update prepares the replies to go over the reverse of rawPath, if the peer switched paths.
+func (p *peerConn) update(rawPath snet.RawPath, underlay *net.UDPAddr) error {
+	if p.sendState.Load() != nil && bytes.Equal(p.rawPath, rawPath.Raw) && p.underlay.AddrPort() == underlay.AddrPort() {
+		return nil
+	}
+
+	// The reply pather reverses the path in place, it must not work on the read buffer.
+	raw := bytes.Clone(rawPath.Raw)
+	replyPath, err := p.listener.replyPather.ReplyPath(snet.RawPath{
+		PathType: rawPath.PathType,
+		Raw:      bytes.Clone(raw),
+	})
+	if err != nil {
+		return err
+	}
+
+	remoteAddr := &snet.UDPAddr{
+		IA: p.key.ia,
+		Host: &net.UDPAddr{
+			IP:   p.key.host.Addr().AsSlice(),
+			Port: int(p.key.host.Port()),
+		},
+		Path:    replyPath,
+		NextHop: underlay,
+	}
+	packetSerializer, err := NewPacketSerializer(
+		p.listener.connectivityContext.LocalIA,
+		p.listener.listenAddr,
+		remoteAddr,
+	)
+	if err != nil {
+		return err
+	}
+	packetSerializer.SetMTU(p.listener.connectivityContext.pathMTU(nil))
+
+	p.listener.logger.Debug("Prepared reply path", "remote", remoteAddr, "next_hop", underlay)
+	p.sendState.Store(&sendState{
+		remoteAddr:       remoteAddr,
+		nextHop:          underlay,
+		packetSerializer: packetSerializer,
+	})
+	p.rawPath = raw
+	p.underlay = underlay
+	return nil
+}
+
+func (p *peerConn) push(payload []byte) {
+	select {
+	case p.incoming <- payload:
+	default:
+	}
+}
+
+func (p *peerConn) Read(b []byte) (int, error) {
+	select {
+	case <-p.closeChan:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	select {
+	case payload := <-p.incoming:
+		return copy(b, payload), nil
+	case <-p.closeChan:
+		return 0, net.ErrClosed
+	case <-p.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (p *peerConn) Write(b []byte) (int, error) {
+	select {
+	case <-p.closeChan:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	state := p.sendState.Load()
+
+	bufferPtr := getPacketBuffer(state.packetSerializer)
+	defer packetBuffers.Put(bufferPtr)
+
+	buffer, err := state.packetSerializer.SerializeTo(*bufferPtr, b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := p.listener.transportConn.WriteTo(buffer, state.nextHop); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// MaxPayloadSize returns the largest payload Write accepts without returning a MessageTooBigError.
+func (p *peerConn) MaxPayloadSize() int {
+	return p.sendState.Load().packetSerializer.MaxPayloadSize()
+}
+
+// Close closes the connection to the peer. Further packets from the peer are returned by Accept
+// as a new connection.
+func (p *peerConn) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closeChan)
+		p.listener.removePeer(p)
+	})
+	return nil
+}
+
+func (p *peerConn) LocalAddr() net.Addr {
+	return p.listener.listenAddr
+}
+
+func (p *peerConn) RemoteAddr() net.Addr {
+	return p.sendState.Load().remoteAddr
+}
+
+func (p *peerConn) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *peerConn) SetReadDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline has no effect, writes go to the socket shared by all peers and do not block.
+func (p *peerConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// deadline is a read deadline that can be waited for and changed while Read is blocked.
+type deadline struct {
+	mtx     sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+// set changes the deadline, the zero time removes it.
+func (d *deadline) set(t time.Time) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired, wait until it closed expired.
+		<-d.expired
+	}
+	d.timer = nil
+
+	select {
+	case <-d.expired:
+		d.expired = nil
+	default:
+	}
+	if d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+
+	if t.IsZero() {
+		return
+	}
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.expired)
+		return
+	}
+	expired := d.expired
+	d.timer = time.AfterFunc(dur, func() { close(expired) })
+}
+
+// wait returns a channel that is closed once the deadline passed.
+func (d *deadline) wait() <-chan struct{} {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+	return d.expired
+}
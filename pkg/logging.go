@@ -0,0 +1,16 @@
+package optimizedconn
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardLogger is the logger of connections without WithLogger, it drops all records.
+var discardLogger = slog.New(discardHandler{})
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
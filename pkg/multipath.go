@@ -0,0 +1,199 @@
+package optimizedconn
+
+import (
+	"context"
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// PathScheduler decides which path of a multipath connection carries the next Write.
+// Implementations must be safe for concurrent use.
+type PathScheduler interface {
+	// Next returns the index of the path used to send b. paths contains at least one path.
+	Next(b []byte, paths []snet.Path) int
+}
+
+// RoundRobinScheduler uses all paths in turn.
+type RoundRobinScheduler struct {
+	counter atomic.Uint64
+}
+
+func (s *RoundRobinScheduler) Next(_ []byte, paths []snet.Path) int {
+	return int((s.counter.Add(1) - 1) % uint64(len(paths)))
+}
+
+// WeightedScheduler distributes writes proportionally to the weight of each path.
+// Without Weight, the announced bottleneck bandwidth is used. Paths with weight 0 get weight 1.
+type WeightedScheduler struct {
+	Weight func(path snet.Path) uint64
+
+	counter atomic.Uint64
+	// weights caches the weights of the last path set, which only changes on path refresh.
+	weights atomic.Pointer[pathWeights]
+}
+
+type pathWeights struct {
+	fingerprints []PathFingerprint
+	weights      []uint64
+	total        uint64
+}
+
+// matches returns whether pW was computed for paths.
+func (pW *pathWeights) matches(paths []snet.Path) bool {
+	if len(pW.fingerprints) != len(paths) {
+		return false
+	}
+	for i, path := range paths {
+		if pW.fingerprints[i] != Fingerprint(path) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *WeightedScheduler) Next(_ []byte, paths []snet.Path) int {
+	pW := s.weights.Load()
+	if pW == nil || !pW.matches(paths) {
+		pW = s.computeWeights(paths)
+		s.weights.Store(pW)
+	}
+
+	// Fibonacci hashing spreads consecutive writes over the paths instead of sending
+	// bursts of weight many writes on each path.
+	slot := (s.counter.Add(1) * 0x9E3779B97F4A7C15) % pW.total
+	for i, w := range pW.weights {
+		if slot < w {
+			return i
+		}
+		slot -= w
+	}
+	return len(paths) - 1
+}
+
+func (s *WeightedScheduler) computeWeights(paths []snet.Path) *pathWeights {
+	weight := s.Weight
+	if weight == nil {
+		weight = pathBandwidth
+	}
+
+	pW := pathWeights{
+		fingerprints: make([]PathFingerprint, len(paths)),
+		weights:      make([]uint64, len(paths)),
+	}
+	for i, path := range paths {
+		pW.fingerprints[i] = Fingerprint(path)
+		pW.weights[i] = max(weight(path), 1)
+		pW.total += pW.weights[i]
+	}
+	return &pW
+}
+
+// FlowHashScheduler keeps all writes of one flow on the same path, to avoid reordering within flows.
+// FlowKey extracts the flow identifier from the payload, the whole payload is hashed without it.
+type FlowHashScheduler struct {
+	FlowKey func(b []byte) []byte
+}
+
+func (s *FlowHashScheduler) Next(b []byte, paths []snet.Path) int {
+	key := b
+	if s.FlowKey != nil {
+		key = s.FlowKey(b)
+	}
+	h := fnv.New64a()
+	h.Write(key)
+	return int(h.Sum64() % uint64(len(paths)))
+}
+
+// multipathState holds one sendState per path used by a multipath connection.
+type multipathState struct {
+	paths  []snet.Path
+	states []*sendState
+}
+
+func (mS *multipathState) next(scheduler PathScheduler, b []byte) *sendState {
+	return mS.states[scheduler.Next(b, mS.paths)]
+}
+
+// setMultipath looks up paths to remoteAddr and prepares a sendState for each of the selected paths.
+// The first path also becomes the regular sendState of the connection, it is returned.
+func (oSC *OptimizedSCIONConn) setMultipath(ctx context.Context, remoteAddr *snet.UDPAddr) (*sendState, error) {
+	paths, err := oSC.connectivityContext.resolvePaths(ctx, remoteAddr, &oSC.options)
+	if err != nil {
+		return nil, err
+	}
+	paths = selectDisjointPaths(paths, oSC.options.multipathPaths)
+
+	mS := multipathState{
+		paths:  paths,
+		states: make([]*sendState, len(paths)),
+	}
+	for i, path := range paths {
+		pathRemoteAddr := remoteAddr.Copy()
+		pathRemoteAddr.Path = dataplanePath(path)
+		pathRemoteAddr.NextHop = nil
+
+		nextHop, err := oSC.connectivityContext.ResolveNextHop(ctx, pathRemoteAddr, path)
+		if err != nil {
+			return nil, err
+		}
+		state, err := oSC.newSendState(pathRemoteAddr, nextHop, path)
+		if err != nil {
+			return nil, err
+		}
+		mS.states[i] = state
+		oSC.options.logger.Debug("Selected multipath path", "remote", pathRemoteAddr, "path", path, "next_hop", nextHop)
+	}
+
+	if err := oSC.storeLookedUpState(mS.states[0], &mS); err != nil {
+		return nil, err
+	}
+	return mS.states[0], nil
+}
+
+// selectDisjointPaths picks up to n paths, keeping their order. Paths that share no interface
+// with already picked paths are preferred, others are only used to fill up the remaining slots.
+func selectDisjointPaths(paths []snet.Path, n int) []snet.Path {
+	if n <= 0 || n >= len(paths) {
+		return paths
+	}
+
+	selected := make([]snet.Path, 0, n)
+	used := make(map[snet.PathInterface]struct{})
+	picked := make([]bool, len(paths))
+	for i, path := range paths {
+		if len(selected) == n {
+			break
+		}
+		metadata := path.Metadata()
+		if metadata == nil {
+			continue
+		}
+		disjoint := true
+		for _, intf := range metadata.Interfaces {
+			if _, ok := used[intf]; ok {
+				disjoint = false
+				break
+			}
+		}
+		if !disjoint {
+			continue
+		}
+		for _, intf := range metadata.Interfaces {
+			used[intf] = struct{}{}
+		}
+		selected = append(selected, path)
+		picked[i] = true
+	}
+
+	for i, path := range paths {
+		if len(selected) == n {
+			break
+		}
+		if !picked[i] {
+			selected = append(selected, path)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,116 @@
+package optimizedconn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+// nextHopResolver caches the underlay addresses of the border routers of the local AS by interface ID.
+type nextHopResolver struct {
+	mtx        sync.Mutex
+	interfaces map[uint16]netip.AddrPort
+}
+
+// ResolveNextHop returns the underlay address that packets to remoteAddr are sent to:
+//
+//   - remoteAddr.NextHop, if it is set.
+//   - Within the local AS, the remote host itself on its own port. This also applies to remotes on
+//     the same host, without a dispatcher every SCION socket receives on its own underlay port.
+//   - The next hop of path, if it is set.
+//   - Otherwise, the internal address of the border router owning the egress interface of the first
+//     hop, as reported by the daemon or the topology file.
+//
+// The dataplane path is taken from path, or from remoteAddr.Path if path is nil.
+func (cC *ConnectivityContext) ResolveNextHop(ctx context.Context, remoteAddr *snet.UDPAddr, path snet.Path) (*net.UDPAddr, error) {
+	if remoteAddr.NextHop != nil {
+		return remoteAddr.NextHop, nil
+	}
+
+	if cC.LocalIA.Equal(remoteAddr.IA) {
+		return &net.UDPAddr{
+			IP:   remoteAddr.Host.IP,
+			Port: remoteAddr.Host.Port,
+			Zone: remoteAddr.Host.Zone,
+		}, nil
+	}
+
+	dataplane := remoteAddr.Path
+	if path != nil {
+		if nextHop := path.UnderlayNextHop(); nextHop != nil {
+			return nextHop, nil
+		}
+		dataplane = path.Dataplane()
+	}
+
+	egress, err := firstHopEgress(dataplane)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrNoNextHop, remoteAddr.IA, err)
+	}
+	return cC.borderRouter(ctx, egress)
+}
+
+// borderRouter returns the internal underlay address of the border router owning the interface egress.
+// The interfaces are loaded from the daemon on first use and reloaded if egress is unknown.
+func (cC *ConnectivityContext) borderRouter(ctx context.Context, egress uint16) (*net.UDPAddr, error) {
+	cC.nextHops.mtx.Lock()
+	defer cC.nextHops.mtx.Unlock()
+
+	underlay, ok := cC.nextHops.interfaces[egress]
+	if !ok {
+		interfaces, err := cC.Daemon().Interfaces(ctx)
+		if err != nil {
+			return nil, daemonError(ctx, "interfaces", err)
+		}
+		cC.nextHops.interfaces = interfaces
+		underlay, ok = interfaces[egress]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown interface %d", ErrNoNextHop, egress)
+	}
+	return net.UDPAddrFromAddrPort(underlay), nil
+}
+
+// firstHopEgress returns the interface the dataplane path leaves the local AS through.
+func firstHopEgress(dataplane snet.DataplanePath) (uint16, error) {
+	var raw *scion.Raw
+	switch p := dataplane.(type) {
+	case snetpath.SCION:
+		raw = &scion.Raw{}
+		if err := raw.DecodeFromBytes(p.Raw); err != nil {
+			return 0, err
+		}
+	case *snetpath.EPIC:
+		// SetPath of EPIC paths advances the packet counter, decode the SCION path instead.
+		raw = &scion.Raw{}
+		if err := raw.DecodeFromBytes(p.SCION); err != nil {
+			return 0, err
+		}
+	case snet.RawReplyPath:
+		var ok bool
+		if raw, ok = p.Path.(*scion.Raw); !ok {
+			return 0, fmt.Errorf("unsupported reply path type %T", p.Path)
+		}
+	default:
+		return 0, fmt.Errorf("unsupported path type %T", dataplane)
+	}
+
+	info, err := raw.GetCurrentInfoField()
+	if err != nil {
+		return 0, err
+	}
+	hop, err := raw.GetCurrentHopField()
+	if err != nil {
+		return 0, err
+	}
+	if info.ConsDir {
+		return hop.ConsEgress, nil
+	}
+	return hop.ConsIngress, nil
+}
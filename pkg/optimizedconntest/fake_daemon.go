@@ -0,0 +1,293 @@
+// Package optimizedconntest provides a fake SCION daemon for testing code that uses the
+// connections of package optimizedconn without a SCION network.
+package optimizedconntest
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/drkey"
+	"github.com/scionproto/scion/pkg/private/ctrl/path_mgmt"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/segment/iface"
+	"github.com/scionproto/scion/pkg/slayers/path"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+// FakeDaemon is a daemon.Connector that answers from scripted data instead of a SCION daemon.
+// It allows testing code that uses connections of this package offline:
+//
+//	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+//	fakeDaemon.SetPaths(remoteIA, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, nextHop))
+//	cC, err := optimizedconn.NewConnectivityContext(ctx, fakeDaemon)
+//	conn, err := optimizedconn.Dial(listenAddr, remoteAddr, optimizedconn.WithConnectivityContext(cC))
+//
+// All methods are safe for concurrent use, the script can be changed while connections use it.
+type FakeDaemon struct {
+	mtx sync.Mutex
+
+	localIA    addr.IA
+	mtu        uint16
+	portStart  uint16
+	portEnd    uint16
+	paths      map[addr.IA][]snet.Path
+	interfaces map[uint16]netip.AddrPort
+
+	errs   map[string]error
+	delay  time.Duration
+	calls  map[string]int
+	closed bool
+}
+
+var _ daemon.Connector = &FakeDaemon{}
+
+// errNotSupported is returned by the parts of the daemon API the FakeDaemon cannot script.
+var errNotSupported = serrors.New("not supported by FakeDaemon")
+
+// NewFakeDaemon creates a FakeDaemon for the AS localIA with an MTU of 1472 and no paths.
+func NewFakeDaemon(localIA addr.IA) *FakeDaemon {
+	return &FakeDaemon{
+		localIA:    localIA,
+		mtu:        1472,
+		portStart:  31000,
+		portEnd:    32767,
+		paths:      make(map[addr.IA][]snet.Path),
+		interfaces: make(map[uint16]netip.AddrPort),
+		errs:       make(map[string]error),
+		calls:      make(map[string]int),
+	}
+}
+
+// SetLocalIA changes the local AS reported by LocalIA and ASInfo.
+func (fD *FakeDaemon) SetLocalIA(localIA addr.IA) {
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	fD.localIA = localIA
+}
+
+// SetMTU changes the MTU of the local AS reported by ASInfo.
+func (fD *FakeDaemon) SetMTU(mtu uint16) {
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	fD.mtu = mtu
+}
+
+// SetPaths replaces the paths returned for the destination AS dst. Without paths, no path
+// to dst is known.
+func (fD *FakeDaemon) SetPaths(dst addr.IA, paths ...snet.Path) {
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	if len(paths) == 0 {
+		delete(fD.paths, dst)
+		return
+	}
+	fD.paths[dst] = append([]snet.Path(nil), paths...)
+}
+
+// SetInterface sets the underlay address of the border router owning the interface id.
+func (fD *FakeDaemon) SetInterface(id uint16, underlay netip.AddrPort) {
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	fD.interfaces[id] = underlay
+}
+
+// SetError makes the daemon.Connector method with the name method, e.g. "Paths", return err.
+// A nil err removes a previously set error.
+func (fD *FakeDaemon) SetError(method string, err error) {
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	if err == nil {
+		delete(fD.errs, method)
+		return
+	}
+	fD.errs[method] = err
+}
+
+// SetDelay makes every request take delay, or until the context of the request is done,
+// to simulate a slow or hanging daemon.
+func (fD *FakeDaemon) SetDelay(delay time.Duration) {
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	fD.delay = delay
+}
+
+// Calls returns how often the daemon.Connector method with the name method was called.
+func (fD *FakeDaemon) Calls(method string) int {
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	return fD.calls[method]
+}
+
+// Closed returns whether Close was called.
+func (fD *FakeDaemon) Closed() bool {
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	return fD.closed
+}
+
+// call records a call of method and returns its scripted error after the scripted delay.
+func (fD *FakeDaemon) call(ctx context.Context, method string) error {
+	fD.mtx.Lock()
+	fD.calls[method]++
+	err := fD.errs[method]
+	delay := fD.delay
+	fD.mtx.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+func (fD *FakeDaemon) LocalIA(ctx context.Context) (addr.IA, error) {
+	if err := fD.call(ctx, "LocalIA"); err != nil {
+		return 0, err
+	}
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	return fD.localIA, nil
+}
+
+func (fD *FakeDaemon) PortRange(ctx context.Context) (uint16, uint16, error) {
+	if err := fD.call(ctx, "PortRange"); err != nil {
+		return 0, 0, err
+	}
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	return fD.portStart, fD.portEnd, nil
+}
+
+func (fD *FakeDaemon) Interfaces(ctx context.Context) (map[uint16]netip.AddrPort, error) {
+	if err := fD.call(ctx, "Interfaces"); err != nil {
+		return nil, err
+	}
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	interfaces := make(map[uint16]netip.AddrPort, len(fD.interfaces))
+	for id, underlay := range fD.interfaces {
+		interfaces[id] = underlay
+	}
+	return interfaces, nil
+}
+
+func (fD *FakeDaemon) Paths(ctx context.Context, dst, _ addr.IA, _ daemon.PathReqFlags) ([]snet.Path, error) {
+	if err := fD.call(ctx, "Paths"); err != nil {
+		return nil, err
+	}
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	return append([]snet.Path(nil), fD.paths[dst]...), nil
+}
+
+func (fD *FakeDaemon) ASInfo(ctx context.Context, ia addr.IA) (daemon.ASInfo, error) {
+	if err := fD.call(ctx, "ASInfo"); err != nil {
+		return daemon.ASInfo{}, err
+	}
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	if ia.IsZero() {
+		ia = fD.localIA
+	}
+	return daemon.ASInfo{IA: ia, MTU: fD.mtu}, nil
+}
+
+func (fD *FakeDaemon) SVCInfo(ctx context.Context, _ []addr.SVC) (map[addr.SVC][]string, error) {
+	if err := fD.call(ctx, "SVCInfo"); err != nil {
+		return nil, err
+	}
+	return map[addr.SVC][]string{}, nil
+}
+
+func (fD *FakeDaemon) RevNotification(ctx context.Context, _ *path_mgmt.RevInfo) error {
+	return fD.call(ctx, "RevNotification")
+}
+
+func (fD *FakeDaemon) DRKeyGetASHostKey(_ context.Context, _ drkey.ASHostMeta) (drkey.ASHostKey, error) {
+	return drkey.ASHostKey{}, errNotSupported
+}
+
+func (fD *FakeDaemon) DRKeyGetHostASKey(_ context.Context, _ drkey.HostASMeta) (drkey.HostASKey, error) {
+	return drkey.HostASKey{}, errNotSupported
+}
+
+func (fD *FakeDaemon) DRKeyGetHostHostKey(_ context.Context, _ drkey.HostHostMeta) (drkey.HostHostKey, error) {
+	return drkey.HostHostKey{}, errNotSupported
+}
+
+func (fD *FakeDaemon) Close() error {
+	fD.mtx.Lock()
+	defer fD.mtx.Unlock()
+	fD.closed = true
+	return nil
+}
+
+// NewFakePath creates a path from src to dst crossing the link between the interface egress of
+// src and ingress of dst. The path has a valid SCION header that expires in about six hours,
+// but carries no valid hop field MACs, so it is only usable if nextHop is the remote host itself
+// instead of a border router.
+func NewFakePath(src, dst addr.IA, egress, ingress uint16, nextHop *net.UDPAddr) snet.Path {
+	decoded := scion.Decoded{
+		Base: scion.Base{
+			PathMeta: scion.MetaHdr{SegLen: [3]uint8{2, 0, 0}},
+			NumINF:   1,
+			NumHops:  2,
+		},
+		InfoFields: []path.InfoField{{
+			ConsDir:   true,
+			Timestamp: uint32(time.Now().Unix()),
+		}},
+		HopFields: []path.HopField{
+			{ConsEgress: egress, ExpTime: 63},
+			{ConsIngress: ingress, ExpTime: 63},
+		},
+	}
+	raw := make([]byte, decoded.Len())
+	if err := decoded.SerializeTo(raw); err != nil {
+		// The path is constructed above and always valid.
+		panic(err)
+	}
+
+	return snetpath.Path{
+		Src:           src,
+		Dst:           dst,
+		DataplanePath: snetpath.SCION{Raw: raw},
+		NextHop:       nextHop,
+		Meta: snet.PathMetadata{
+			Interfaces: []snet.PathInterface{
+				{IA: src, ID: iface.ID(egress)},
+				{IA: dst, ID: iface.ID(ingress)},
+			},
+			Expiry: pathExpiry(&decoded),
+		},
+	}
+}
+
+// pathExpiry returns the earliest expiration time of all hop fields of decoded.
+func pathExpiry(decoded *scion.Decoded) time.Time {
+	var expiry time.Time
+	hop := 0
+	for i, info := range decoded.InfoFields {
+		timestamp := time.Unix(int64(info.Timestamp), 0)
+		for j := 0; j < int(decoded.PathMeta.SegLen[i]); j++ {
+			hopExpiry := timestamp.Add(path.ExpTimeToDuration(decoded.HopFields[hop].ExpTime))
+			if expiry.IsZero() || hopExpiry.Before(expiry) {
+				expiry = hopExpiry
+			}
+			hop++
+		}
+	}
+	return expiry
+}
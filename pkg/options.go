@@ -0,0 +1,139 @@
+package optimizedconn
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Option configures optional behaviour of the connections returned by Listen, Dial and ListenPacket.
+type Option func(*connOptions)
+
+type connOptions struct {
+	pathSelector      PathSelector
+	pathPolicy        *PathPolicy
+	pathRefreshMargin time.Duration
+
+	// multipathPaths is 0, unless multipath mode is enabled.
+	multipathPaths     int
+	multipathScheduler PathScheduler
+
+	// failover is nil, unless failover is enabled.
+	failover *failoverManager
+
+	serializerCacheSize int
+	serializerCacheTTL  time.Duration
+
+	// connectivityContext is nil, unless the caller provides one.
+	connectivityContext *ConnectivityContext
+
+	sourcePolicy     SourcePolicy
+	checkDestination bool
+
+	logger *slog.Logger
+}
+
+func newConnOptions(opts []Option) connOptions {
+	options := connOptions{
+		pathSelector:      FirstPathSelector{},
+		pathRefreshMargin: defaultPathRefreshMargin,
+		logger:            discardLogger,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithConnectivityContext makes the connection use connectivityContext instead of
+// connecting to the SCION daemon on its own, e.g. one created by PrepareConnectivityContext and
+// shared by many connections, or one created by NewTopologyConnectivityContext.
+// The connection holds a reference to connectivityContext until it is closed.
+func WithConnectivityContext(connectivityContext *ConnectivityContext) Option {
+	return func(o *connOptions) {
+		o.connectivityContext = connectivityContext
+	}
+}
+
+// WithLogger makes the connection log to logger. Path and next hop decisions are logged at debug level,
+// failed path refreshes as warnings and failover switches as info. Connections log nothing by default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *connOptions) {
+		if logger == nil {
+			logger = discardLogger
+		}
+		o.logger = logger
+	}
+}
+
+// WithPathSelector sets the selector used to pick a path whenever paths are looked up
+// from the daemon. Defaults to FirstPathSelector.
+func WithPathSelector(selector PathSelector) Option {
+	return func(o *connOptions) {
+		o.pathSelector = selector
+	}
+}
+
+// WithPathPolicy filters and orders the paths looked up from the daemon before the
+// PathSelector picks one of them.
+func WithPathPolicy(policy *PathPolicy) Option {
+	return func(o *connOptions) {
+		o.pathPolicy = policy
+	}
+}
+
+// WithPathRefreshMargin sets how long before its expiry a path looked up by Dial is replaced
+// by a fresh one. Defaults to one minute.
+func WithPathRefreshMargin(margin time.Duration) Option {
+	return func(o *connOptions) {
+		o.pathRefreshMargin = margin
+	}
+}
+
+// WithMultipath makes Dial use up to maxPaths paths at once, preferring paths that share
+// no interface. Writes are distributed over the paths by scheduler, which defaults to a
+// RoundRobinScheduler. Multipath mode only applies if Dial looks up the paths itself.
+func WithMultipath(maxPaths int, scheduler PathScheduler) Option {
+	return func(o *connOptions) {
+		if scheduler == nil {
+			scheduler = &RoundRobinScheduler{}
+		}
+		o.multipathPaths = maxPaths
+		o.multipathScheduler = scheduler
+	}
+}
+
+// WithFailover makes connections switch to another path when their path is reported down,
+// either by SCMP errors or by missing probe replies reported with ReportProbe.
+// Failover only applies to paths that were looked up by the connection itself.
+func WithFailover(config FailoverConfig) Option {
+	return func(o *connOptions) {
+		o.failover = newFailoverManager(config)
+	}
+}
+
+// WithSerializerCache bounds the number of destination and path combinations
+// ListenPacket connections keep prepared packets for. Least recently used entries are
+// evicted once size is reached, and entries idle for longer than ttl are evicted if ttl
+// is positive. Entries with expired paths are always evicted. Defaults to 1024 entries without TTL.
+func WithSerializerCache(size int, ttl time.Duration) Option {
+	return func(o *connOptions) {
+		o.serializerCacheSize = size
+		o.serializerCacheTTL = ttl
+	}
+}
+
+// WithSourcePolicy sets how connections returned by Listen handle packets from sources other
+// than the remote learned from the first packet. Defaults to SourceLock.
+func WithSourcePolicy(policy SourcePolicy) Option {
+	return func(o *connOptions) {
+		o.sourcePolicy = policy
+	}
+}
+
+// WithDestinationCheck makes Read of connections with a remote also drop packets whose SCION
+// destination IA, host or port differ from the local address of the connection.
+func WithDestinationCheck() Option {
+	return func(o *connOptions) {
+		o.checkDestination = true
+	}
+}
@@ -1,15 +1,16 @@
 package optimizedconn
 
 import (
-	"bytes"
 	"context"
+	"fmt"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/addr"
 	"github.com/scionproto/scion/pkg/snet"
-	"github.com/scionproto/scion/private/topology"
 )
 
 type OptimizedSCIONPacketConn struct {
@@ -26,41 +27,115 @@ type OptimizedSCIONPacketConn struct {
 	// Otherwise the connection does not support send functionality.
 	remoteAddr        *snet.UDPAddr
 	nextHop           *net.UDPAddr
-	packetSerializers map[string]*PacketSerializer
+	serializersMtx    sync.Mutex
+	packetSerializers *serializerCache
+	// lookups holds the entries being prepared, guarded by serializersMtx.
+	lookups map[remoteKey]*remoteLookup
+	// writeDeadline is the write deadline in Unix nanoseconds, 0 if none is set. It bounds path lookups.
+	writeDeadline atomic.Int64
 
 	connectivityContext *ConnectivityContext
+	options             connOptions
+
+	// closeOnce releases connectivityContext on the first Close.
+	closeOnce sync.Once
+}
+
+// remoteKey identifies a destination and the path used to reach it.
+// It can be built without allocating, unlike the string representation of the address.
+type remoteKey struct {
+	ia   addr.IA
+	host netip.AddrPort
+	// svc is the service of SVC destinations, which have no host, and addr.SvcNone otherwise.
+	svc  addr.SVC
+	path PathFingerprint
+}
+
+func newRemoteKey(remoteAddr *snet.UDPAddr, path snet.Path) remoteKey {
+	hostIP, _ := netip.AddrFromSlice(remoteAddr.Host.IP)
+	return remoteKey{
+		ia:   remoteAddr.IA,
+		host: netip.AddrPortFrom(hostIP.Unmap(), uint16(remoteAddr.Host.Port)),
+		svc:  addr.SvcNone,
+		path: remotePathKey(path),
+	}
+}
+
+// remotePathKey identifies path within the serializer cache. Unlike Fingerprint, it changes
+// with the hop fields, so a refreshed path never reuses the serializer of the old one.
+func remotePathKey(path snet.Path) PathFingerprint {
+	if path == nil {
+		return 0
+	}
+	return DataplaneFingerprint(path.Dataplane())
+}
+
+// remoteEntry bundles everything needed to send to one destination over one path.
+type remoteEntry struct {
+	// remoteAddr is a *snet.UDPAddr or, for service destinations, a *snet.SVCAddr.
+	remoteAddr net.Addr
+	serializer *PacketSerializer
+	// nextHop is resolved once per entry, refreshAt is only set if the path was looked up by
+	// the connection itself.
+	nextHop   *net.UDPAddr
+	refreshAt time.Time
+
+	path snet.Path
+	// expiry is cached, since the metadata of daemon paths is copied on every access.
+	expiry   time.Time
+	lookedUp bool
+	// failure is set if the looked up path was reported down, the next write then looks up another path.
+	failure error
 }
 
 var _ net.Conn = &OptimizedSCIONConn{}
 
-func ListenPacket(listenAddr *net.UDPAddr) (*OptimizedSCIONPacketConn, error) {
+// ListenPacket opens a connection that can send to and receive from any SCION address.
+// Destinations without a path get a path looked up from the daemon and picked by the
+// configured PathSelector.
+func ListenPacket(listenAddr *net.UDPAddr, opts ...Option) (*OptimizedSCIONPacketConn, error) {
+	return ListenPacketContext(context.Background(), listenAddr, opts...)
+}
+
+// ListenPacketContext is like ListenPacket, but ctx bounds the connection to the SCION daemon and
+// the lookup of the local AS. If the daemon fails or ctx is done first, a DaemonError is returned.
+// Path lookups of WriteTo are bounded by their own timeout.
+func ListenPacketContext(ctx context.Context, listenAddr *net.UDPAddr, opts ...Option) (*OptimizedSCIONPacketConn, error) {
 
 	if listenAddr == nil || listenAddr.IP == nil || listenAddr.IP.IsUnspecified() {
-		return nil, serrors.New("listen addr is unspecified")
+		return nil, ErrUnspecifiedListenAddr
 	}
 
-	ctx := context.Background()
-	connectivityContext, err := PrepareConnectivityContext(ctx)
+	options := newConnOptions(opts)
+	connectivityContext, err := acquireConnectivityContext(ctx, options.connectivityContext)
 	if err != nil {
 		return nil, err
 	}
 
 	var udpTransportConn MergedConn
 
-	udpTransportConn, err = net.ListenUDP("udp4", listenAddr)
+	udpTransportConn, err = net.ListenUDP(listenNetwork(listenAddr), listenAddr)
 	if err != nil {
+		connectivityContext.release()
 		return nil, err
 	}
 
+	// Use the bound address, listenAddr may leave the port to the OS.
+	listenAddr = udpTransportConn.LocalAddr().(*net.UDPAddr)
+	options.logger = options.logger.With("local", listenAddr)
+
 	packetParser, err := NewPacketParser()
 
 	if err != nil {
+		udpTransportConn.Close()
+		connectivityContext.release()
 		return nil, err
 	}
 
 	optimizedSCIONConn := OptimizedSCIONPacketConn{
 		transportConn:       udpTransportConn,
 		connectivityContext: connectivityContext,
+		options:             options,
 
 		listenAddr: listenAddr,
 		remoteAddr: nil,
@@ -68,13 +143,16 @@ func ListenPacket(listenAddr *net.UDPAddr) (*OptimizedSCIONPacketConn, error) {
 		packetParser: packetParser,
 
 		udpTransportConn:  udpTransportConn,
-		packetSerializers: make(map[string]*PacketSerializer),
+		packetSerializers: newSerializerCache(options.serializerCacheSize, options.serializerCacheTTL),
+		lookups:           make(map[remoteKey]*remoteLookup),
 	}
 
 	return &optimizedSCIONConn, nil
 }
 
-// TODO: This needs to be optimized...
+// PathToString concatenates the interfaces of path. Paths without metadata all map to "".
+//
+// Deprecated: Use Fingerprint, which does not allocate and distinguishes paths without metadata.
 func PathToString(path snet.Path) string {
 	// iterate over path.Metadata().Interfaces and append a string of all interfaces to a string
 	// return the string
@@ -97,54 +175,258 @@ func PathToString(path snet.Path) string {
 	return pathString
 }
 
-func (oSC *OptimizedSCIONPacketConn) addRemote(remoteAddr *snet.UDPAddr) (*PacketSerializer, error) {
+// addRemote returns the cached entry for sending to remoteAddr, creating it if necessary.
+// If via is set, it is used instead of the path of remoteAddr. Lookups do not hold serializersMtx,
+// concurrent writes to the same destination share one lookup, which is bounded by the write deadline.
+func (oSC *OptimizedSCIONPacketConn) addRemote(remoteAddr *snet.UDPAddr, via snet.Path) (*remoteEntry, error) {
+
+	path := via
+	if path == nil {
+		var err error
+		path, err = remoteAddr.GetPath()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key := newRemoteKey(remoteAddr, path)
+
+	oSC.serializersMtx.Lock()
+	entry, ok := oSC.packetSerializers.get(key)
+	if ok && !entry.refreshAt.IsZero() && time.Now().After(entry.refreshAt) {
+		// The looked up path is about to expire, look up a fresh one.
+		ok = false
+	}
+	var failed *remoteEntry
+	if ok && entry.failure != nil {
+		// The path was reported down, look up another one.
+		failed, ok = entry, false
+	}
+	if ok {
+		oSC.serializersMtx.Unlock()
+		return entry, nil
+	}
+	lookup, started := oSC.startLookup(key)
+	oSC.serializersMtx.Unlock()
+
+	ctx, cancel := oSC.lookupContext()
+	defer cancel()
+	if !started {
+		return lookup.wait(ctx)
+	}
 
-	path, err := remoteAddr.GetPath()
+	entry, err := oSC.newRemoteEntry(ctx, remoteAddr, via, path)
+	oSC.finishLookup(key, lookup, entry, err)
 	if err != nil {
 		return nil, err
 	}
 
-	ps, ok := oSC.packetSerializers[remoteAddr.String()+"-"+PathToString(path)]
-	if !ok {
-		// We check, if there is a path.
-
-		nextHop := remoteAddr.NextHop
-
-		// fmt.Printf("localIA=%v, remoteIA=%v\n", oSC.connectivityContext.LocalIA.String(), remoteAddr.IA.String())
-		if nextHop == nil && oSC.connectivityContext.LocalIA.Equal(remoteAddr.IA) {
-			if bytes.Equal(remoteAddr.Host.IP, oSC.listenAddr.IP) {
-				nextHop = &net.UDPAddr{
-					IP:   remoteAddr.Host.IP,
-					Port: remoteAddr.Host.Port,
-					Zone: remoteAddr.Host.Zone,
-				}
-			} else {
-				nextHop = &net.UDPAddr{
-					IP:   remoteAddr.Host.IP,
-					Port: topology.EndhostPort,
-					Zone: remoteAddr.Host.Zone,
-				}
-			}
+	// The callback may use the connection, it must not run under serializersMtx.
+	if failed != nil && oSC.options.failover.config.OnSwitch != nil {
+		oSC.options.failover.config.OnSwitch(FailoverEvent{
+			RemoteAddr: entry.remoteAddr.(*snet.UDPAddr),
+			From:       failed.path,
+			To:         entry.path,
+			Reason:     failed.failure,
+		})
+	}
+	return entry, nil
+}
+
+// newRemoteEntry prepares sending to remoteAddr over path. If remoteAddr has no path and via is nil,
+// a path is looked up.
+func (oSC *OptimizedSCIONPacketConn) newRemoteEntry(ctx context.Context, remoteAddr *snet.UDPAddr, via, path snet.Path) (*remoteEntry, error) {
+
+	lookedUp := false
+	if via != nil {
+		remoteAddr = remoteAddr.Copy()
+		remoteAddr.Path = dataplanePath(via)
+		remoteAddr.NextHop = nil
+	} else if remoteAddr.Path == nil {
+		// We have to look up a path, the result is cached under the key of the pathless address.
+		var err error
+		remoteAddr = remoteAddr.Copy()
+		path, err = oSC.connectivityContext.resolvePath(ctx, remoteAddr, &oSC.options)
+		if err != nil {
+			return nil, err
 		}
+		lookedUp = !oSC.connectivityContext.LocalIA.Equal(remoteAddr.IA)
+	}
 
-		oSC.remoteAddr = remoteAddr
-		oSC.nextHop = nextHop
+	nextHop, err := oSC.connectivityContext.ResolveNextHop(ctx, remoteAddr, path)
+	if err != nil {
+		return nil, err
+	}
+
+	oSC.options.logger.Debug("Prepared remote", "remote", remoteAddr, "path", path, "next_hop", nextHop)
+
+	packetSerializer, err := NewPacketSerializer(
+		oSC.connectivityContext.LocalIA,
+		oSC.listenAddr,
+		remoteAddr,
+	)
+
+	if err != nil {
+		return nil, err
+	}
 
-		packetSerializer, err := NewPacketSerializer(
-			oSC.connectivityContext.LocalIA,
-			oSC.listenAddr,
-			remoteAddr,
-		)
+	packetSerializer.SetMTU(oSC.connectivityContext.pathMTU(path))
+	entry := &remoteEntry{
+		remoteAddr: remoteAddr,
+		serializer: packetSerializer,
+		nextHop:    nextHop,
+		path:       path,
+		expiry:     pathExpiry(path),
+		lookedUp:   lookedUp,
+	}
+	if entry.expiry.IsZero() && !lookedUp {
+		// Paths set in remoteAddr carry no metadata, their hop fields tell when they expire.
+		entry.expiry = dataplaneExpiry(remoteAddr.Path)
+	}
+	if err := checkExpiry(entry.expiry); err != nil {
+		return nil, err
+	}
+	if entry.lookedUp {
+		entry.refreshAt = entry.expiry.Add(-oSC.options.pathRefreshMargin)
+		if entry.expiry.IsZero() {
+			// Like dialed connections, paths of unknown expiry are looked up again after the retry interval.
+			entry.refreshAt = time.Now().Add(pathRefreshRetryInterval)
+		}
+	}
+	return entry, nil
+}
 
+// addSVCRemote returns the cached entry for sending to the service address svcAddr, creating it if necessary.
+// Like snet, paths to services are not looked up, svcAddr must carry a path unless via is set.
+func (oSC *OptimizedSCIONPacketConn) addSVCRemote(svcAddr *snet.SVCAddr, via snet.Path) (*remoteEntry, error) {
+
+	if via != nil {
+		svcAddr = svcAddr.Copy()
+		svcAddr.Path = dataplanePath(via)
+		svcAddr.NextHop = via.UnderlayNextHop()
+	}
+	if svcAddr.Path == nil {
+		return nil, fmt.Errorf("%w: %s, paths to services are not looked up", ErrNoPath, svcAddr)
+	}
+
+	key := remoteKey{
+		ia:   svcAddr.IA,
+		svc:  svcAddr.SVC,
+		path: DataplaneFingerprint(svcAddr.Path),
+	}
+
+	oSC.serializersMtx.Lock()
+	if entry, ok := oSC.packetSerializers.get(key); ok {
+		oSC.serializersMtx.Unlock()
+		return entry, nil
+	}
+	lookup, started := oSC.startLookup(key)
+	oSC.serializersMtx.Unlock()
+
+	ctx, cancel := oSC.lookupContext()
+	defer cancel()
+	if !started {
+		return lookup.wait(ctx)
+	}
+
+	entry, err := oSC.newSVCRemoteEntry(ctx, svcAddr, via)
+	oSC.finishLookup(key, lookup, entry, err)
+	return entry, err
+}
+
+// newSVCRemoteEntry prepares sending to svcAddr, which carries a path.
+func (oSC *OptimizedSCIONPacketConn) newSVCRemoteEntry(ctx context.Context, svcAddr *snet.SVCAddr, via snet.Path) (*remoteEntry, error) {
+
+	nextHop := svcAddr.NextHop
+	if nextHop == nil {
+		egress, err := firstHopEgress(svcAddr.Path)
 		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrNoNextHop, svcAddr, err)
+		}
+		if nextHop, err = oSC.connectivityContext.borderRouter(ctx, egress); err != nil {
 			return nil, err
 		}
+	}
 
-		oSC.packetSerializers[remoteAddr.String()+"-"+PathToString(path)] = packetSerializer
-		return packetSerializer, nil
+	packetSerializer, err := NewSVCPacketSerializer(
+		oSC.connectivityContext.LocalIA,
+		oSC.listenAddr,
+		svcAddr,
+	)
+	if err != nil {
+		return nil, err
+	}
+	path := via
+	if path == nil {
+		path, _ = svcAddr.GetPath()
 	}
+	packetSerializer.SetMTU(oSC.connectivityContext.pathMTU(path))
+
+	oSC.options.logger.Debug("Prepared service", "remote", svcAddr, "path", path, "next_hop", nextHop)
+	return &remoteEntry{
+		remoteAddr: svcAddr,
+		serializer: packetSerializer,
+		nextHop:    nextHop,
+		path:       path,
+		expiry:     pathExpiry(path),
+	}, nil
+}
+
+// remoteLookup is the preparation of a remote entry in progress. Concurrent writes to the same
+// destination wait for it instead of looking up the path once more.
+type remoteLookup struct {
+	done  chan struct{}
+	entry *remoteEntry
+	err   error
+}
+
+// wait returns the result of the lookup, or the error of ctx if it is done first.
+func (rL *remoteLookup) wait(ctx context.Context) (*remoteEntry, error) {
+	select {
+	case <-rL.done:
+		return rL.entry, rL.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for the path lookup of another write: %w", ctx.Err())
+	}
+}
+
+// startLookup returns the lookup in flight for key, or registers a new one, for which started
+// is true. The caller then has to call finishLookup. serializersMtx must be held.
+func (oSC *OptimizedSCIONPacketConn) startLookup(key remoteKey) (lookup *remoteLookup, started bool) {
+	if lookup, ok := oSC.lookups[key]; ok {
+		return lookup, false
+	}
+	lookup = &remoteLookup{done: make(chan struct{})}
+	oSC.lookups[key] = lookup
+	return lookup, true
+}
 
-	return ps, nil
+// finishLookup caches entry under key, unless the lookup failed, and passes the result
+// to the writes waiting for it.
+func (oSC *OptimizedSCIONPacketConn) finishLookup(key remoteKey, lookup *remoteLookup, entry *remoteEntry, err error) {
+	oSC.serializersMtx.Lock()
+	delete(oSC.lookups, key)
+	if err == nil {
+		if remoteAddr, ok := entry.remoteAddr.(*snet.UDPAddr); ok {
+			oSC.remoteAddr = remoteAddr
+			oSC.nextHop = entry.nextHop
+		}
+		oSC.packetSerializers.put(key, entry)
+	}
+	oSC.serializersMtx.Unlock()
+
+	lookup.entry, lookup.err = entry, err
+	close(lookup.done)
+}
+
+// lookupContext returns the context for the lookups of a write. It ends after pathQueryTimeout
+// or at the write deadline, whichever is earlier.
+func (oSC *OptimizedSCIONPacketConn) lookupContext() (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(pathQueryTimeout)
+	if writeDeadline := oSC.writeDeadline.Load(); writeDeadline != 0 && writeDeadline < deadline.UnixNano() {
+		deadline = time.Unix(0, writeDeadline)
+	}
+	return context.WithDeadline(context.Background(), deadline)
 }
 
 func (c *OptimizedSCIONPacketConn) Close() error {
@@ -157,43 +439,148 @@ func (c *OptimizedSCIONPacketConn) Close() error {
 		}
 	}*/
 
+	c.closeOnce.Do(func() {
+		c.connectivityContext.release()
+	})
+
 	return c.transportConn.Close()
 }
 
+// ReadFrom receives the payload of the next packet into b. Concurrent calls are served one after
+// another, since they share the read buffer.
 func (c *OptimizedSCIONPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMtx.Lock()
+	defer c.readMtx.Unlock()
 
-	n, addr, err := c.transportConn.ReadFrom(c.packetParser.ReadBuffer)
+	for {
+		n, addr, err := c.transportConn.ReadFrom(c.packetParser.ReadBuffer)
 
-	if err != nil {
-		return 0, nil, err
-	}
+		if err != nil {
+			return 0, nil, err
+		}
 
-	payloadLen, err := c.packetParser.Parse(n, b)
+		if c.packetParser.NextHeader() == SCION_PROTOCOL_NUMBER_SCMP {
+			// Only SCMP errors quoting a packet sent by the connection are processed, others are dropped.
+			pkt := snet.Packet{
+				Bytes: snet.Bytes(c.packetParser.ReadBuffer[:n]),
+			}
+			if pkt.Decode() != nil || !quotesPacketTo(&pkt, c.connectivityContext.LocalIA, uint16(c.listenAddr.Port), nil) {
+				continue
+			}
+			// With failover, SCMP errors are consumed by the failover, they are never returned to the caller.
+			if c.options.failover != nil {
+				c.handleSCMP(&pkt)
+				continue
+			}
+			// Without failover, SCMP errors are returned to the caller.
+			if sE := newSCMPError(&pkt); sE != nil {
+				return 0, nil, sE
+			}
+			continue
+		}
 
-	if err != nil {
-		return 0, nil, err
+		payloadLen, err := c.packetParser.Parse(n, b)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		return payloadLen, addr, nil
+	}
+}
+
+// handleSCMP processes an SCMP message received by the connection.
+func (c *OptimizedSCIONPacketConn) handleSCMP(pkt *snet.Packet) {
+	reason := c.options.failover.handleSCMP(pkt)
+	if reason == nil {
+		return
+	}
+	if msg, ok := pkt.Payload.(snet.SCMPDestinationUnreachable); ok {
+		var paths []snet.Path
+		c.serializersMtx.Lock()
+		c.packetSerializers.forEach(func(entry *remoteEntry) {
+			if entry.lookedUp {
+				paths = append(paths, entry.path)
+			}
+		})
+		c.serializersMtx.Unlock()
+		if path := quotedPath(msg.Payload, paths); path != nil {
+			c.options.failover.markPathDown(path)
+		}
 	}
+	c.failDownPaths(reason)
+}
+
+// failDownPaths marks all looked up paths that are down as failed,
+// so that the next write to their destination looks up another path.
+func (c *OptimizedSCIONPacketConn) failDownPaths(reason error) {
+	c.serializersMtx.Lock()
+	defer c.serializersMtx.Unlock()
 
-	return payloadLen, addr, nil
+	c.packetSerializers.forEach(func(entry *remoteEntry) {
+		if entry.lookedUp && entry.failure == nil && c.options.failover.isDown(entry.path) {
+			entry.failure = reason
+		}
+	})
+}
+
+// ReportProbe records whether a probe sent over path was answered. After
+// FailoverConfig.LossThreshold consecutive losses, the path is considered down and
+// destinations using it switch to another path. It has no effect without WithFailover.
+func (c *OptimizedSCIONPacketConn) ReportProbe(path snet.Path, replied bool) {
+	if c.options.failover == nil {
+		return
+	}
+	if c.options.failover.reportProbe(path, replied) {
+		c.failDownPaths(fmt.Errorf("%w: %d probes lost", ErrPathDown, c.options.failover.config.LossThreshold))
+	}
 }
 
 func (c *OptimizedSCIONPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 
-	sAddr, ok := addr.(*snet.UDPAddr)
-	if !ok {
-		return 0, serrors.New("addr is not of type *snet.UDPAddr")
+	return c.WriteToVia(b, addr, nil)
+}
+
+// WriteToVia sends b to addr over path, regardless of the path set in addr.
+// Applications doing their own path scheduling can use it to pin each packet to a path.
+// If path is nil, it behaves like WriteTo. Expired paths are rejected with ErrPathExpired.
+// addr is either a *snet.UDPAddr or a *snet.SVCAddr, paths to service addresses are never looked up.
+func (c *OptimizedSCIONPacketConn) WriteToVia(b []byte, addr net.Addr, path snet.Path) (int, error) {
+
+	if err := checkExpiry(pathExpiry(path)); err != nil {
+		return 0, err
+	}
+
+	var entry *remoteEntry
+	var nextHop *net.UDPAddr
+	var err error
+	switch sAddr := addr.(type) {
+	case *snet.UDPAddr:
+		entry, err = c.addRemote(sAddr, path)
+		nextHop = sAddr.NextHop
+	case *snet.SVCAddr:
+		entry, err = c.addSVCRemote(sAddr, path)
+		nextHop = sAddr.NextHop
+	default:
+		return 0, fmt.Errorf("%w: %T, expected *snet.UDPAddr or *snet.SVCAddr", ErrUnsupportedAddr, addr)
 	}
-	serializer, err := c.addRemote(sAddr)
 	if err != nil {
 		return 0, err
 	}
 
-	buffer, err := serializer.Serialize(b)
+	bufferPtr := getPacketBuffer(entry.serializer)
+	defer packetBuffers.Put(bufferPtr)
+
+	buffer, err := entry.serializer.SerializeTo(*bufferPtr, b)
 	if err != nil {
 		return 0, err
 	}
 
-	nextHop := c.getNextHop(sAddr)
+	// An explicit next hop of the destination takes precedence over the cached one,
+	// unless it belongs to the path of the destination that path replaces.
+	if nextHop == nil || path != nil {
+		nextHop = entry.nextHop
+	}
 
 	_, err = c.transportConn.WriteTo(buffer, nextHop)
 
@@ -203,36 +590,41 @@ func (c *OptimizedSCIONPacketConn) WriteTo(b []byte, addr net.Addr) (int, error)
 	return len(b), nil
 }
 
-func (oSC *OptimizedSCIONPacketConn) getNextHop(remoteAddr *snet.UDPAddr) *net.UDPAddr {
-	nextHop := remoteAddr.NextHop
-
-	if nextHop == nil && oSC.connectivityContext.LocalIA.Equal(remoteAddr.IA) {
-		if bytes.Equal(remoteAddr.Host.IP, oSC.listenAddr.IP) {
-			nextHop = &net.UDPAddr{
-				IP:   remoteAddr.Host.IP,
-				Port: topology.EndhostPort,
-				Zone: remoteAddr.Host.Zone,
-			}
-
-			if oSC.udpTransportConn != nil {
-				nextHop = &net.UDPAddr{
-					IP:   remoteAddr.Host.IP,
-					Port: remoteAddr.Host.Port,
-					Zone: remoteAddr.Host.Zone,
-				}
-			}
+// CachedPaths returns the paths currently cached for each destination, keyed by the
+// string representation of the destination address.
+func (c *OptimizedSCIONPacketConn) CachedPaths() map[string][]snet.Path {
+	c.serializersMtx.Lock()
+	defer c.serializersMtx.Unlock()
+
+	paths := make(map[string][]snet.Path)
+	c.packetSerializers.forEach(func(entry *remoteEntry) {
+		destination := entry.remoteAddr.String()
+		paths[destination] = append(paths[destination], entry.path)
+	})
+	return paths
+}
 
-		} else {
-			nextHop = &net.UDPAddr{
-				IP:   remoteAddr.Host.IP,
-				Port: remoteAddr.Host.Port, // topology.EndhostPort,
-				Zone: remoteAddr.Host.Zone,
-			}
+// SerializerCacheStats returns the counters of the cache holding the prepared packets per destination and path.
+func (c *OptimizedSCIONPacketConn) SerializerCacheStats() SerializerCacheStats {
+	c.serializersMtx.Lock()
+	defer c.serializersMtx.Unlock()
+	return c.packetSerializers.stats()
+}
 
-		}
+// MaxPayloadSize returns the largest payload WriteTo accepts for addr without returning
+// a MessageTooBigError. It prepares addr like WriteTo does: if addr has no path and none is
+// cached yet, a path is looked up from the daemon, which may block for up to the path lookup
+// timeout, and the prepared destination is added to the serializer cache.
+func (c *OptimizedSCIONPacketConn) MaxPayloadSize(addr net.Addr) (int, error) {
+	sAddr, ok := addr.(*snet.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("%w: %T, expected *snet.UDPAddr", ErrUnsupportedAddr, addr)
 	}
-
-	return nextHop
+	entry, err := c.addRemote(sAddr, nil)
+	if err != nil {
+		return 0, err
+	}
+	return entry.serializer.MaxPayloadSize(), nil
 }
 
 func (c *OptimizedSCIONPacketConn) LocalAddr() net.Addr {
@@ -248,6 +640,7 @@ func (c *OptimizedSCIONPacketConn) SetDeadline(t time.Time) error {
 		}
 	}*/
 
+	c.setWriteDeadline(t)
 	return c.transportConn.SetDeadline(t)
 }
 
@@ -272,5 +665,14 @@ func (c *OptimizedSCIONPacketConn) SetWriteDeadline(t time.Time) error {
 		}
 	}*/
 
+	c.setWriteDeadline(t)
 	return c.transportConn.SetWriteDeadline(t)
 }
+
+func (c *OptimizedSCIONPacketConn) setWriteDeadline(t time.Time) {
+	if t.IsZero() {
+		c.writeDeadline.Store(0)
+		return
+	}
+	c.writeDeadline.Store(t.UnixNano())
+}
@@ -2,36 +2,82 @@ package optimizedconn
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"sync"
 
 	"github.com/scionproto/scion/pkg/addr"
 	"github.com/scionproto/scion/pkg/private/common"
+	"github.com/scionproto/scion/pkg/private/serrors"
 	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
 )
 
+// PacketSerializer prepares the headers of packets to one destination over one path once,
+// so that sending a packet only requires copying the payload.
+// SerializeTo is safe for concurrent use, Serialize is not.
 type PacketSerializer struct {
-	baseBytes        snet.Bytes
+	baseBytes snet.Bytes
+	// template is a copy of the prepared headers that is never written to, it is used by SerializeTo.
+	template         []byte
 	headerBytes      int
 	basePayloadBytes int
 
-	listenAddr *net.UDPAddr
-	remoteAddr *snet.UDPAddr
+	srcPort uint16
+	dstPort uint16
+	// mtu is the maximum size of a serialized packet, including all headers.
+	mtu int
+
+	// Only populated for EPIC paths, which need new hop validation fields for every packet.
+	epic *epicState
 }
 
 const SCION_PROTOCOL_NUMBER_SCION_UDP = 17
+const SCION_PROTOCOL_NUMBER_SCMP = 202
 
+// NewPacketSerializer prepares a serializer for packets sent from listenAddr to remoteAddr.
+// The destination host may be an IPv4 or IPv6 address.
 func NewPacketSerializer(localIA addr.IA, listenAddr *net.UDPAddr, remoteAddr *snet.UDPAddr) (*PacketSerializer, error) {
 
+	if remoteAddr.Host == nil {
+		return nil, fmt.Errorf("%w: remote address in %s has no host", ErrUnsupportedAddr, remoteAddr.IA)
+	}
+	destinationHost, err := hostFromIP(remoteAddr.Host.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	scionDestinationAddress := snet.SCIONAddress{
+		IA:   remoteAddr.IA,
+		Host: destinationHost,
+	}
+
+	return newPacketSerializer(localIA, listenAddr, scionDestinationAddress, uint16(remoteAddr.Host.Port), remoteAddr.Path)
+}
+
+// NewSVCPacketSerializer prepares a serializer for packets sent from listenAddr to
+// a SCION service address (e.g. CS_A). Like snet, packets to services use destination port 0.
+func NewSVCPacketSerializer(localIA addr.IA, listenAddr *net.UDPAddr, remoteAddr *snet.SVCAddr) (*PacketSerializer, error) {
+
 	scionDestinationAddress := snet.SCIONAddress{
 		IA:   remoteAddr.IA,
-		Host: addr.MustParseHost(remoteAddr.Host.IP.String()),
+		Host: addr.HostSVC(remoteAddr.SVC),
+	}
+
+	return newPacketSerializer(localIA, listenAddr, scionDestinationAddress, 0, remoteAddr.Path)
+}
+
+func newPacketSerializer(localIA addr.IA, listenAddr *net.UDPAddr, destination snet.SCIONAddress, dstPort uint16, path snet.DataplanePath) (*PacketSerializer, error) {
+
+	listenHost, err := hostFromIP(listenAddr.IP)
+	if err != nil {
+		return nil, err
 	}
 
 	scionListenAddress := snet.SCIONAddress{
 		IA:   localIA,
-		Host: addr.MustParseHost(listenAddr.IP.String()),
+		Host: listenHost,
 	}
 
 	var bytes snet.Bytes
@@ -40,9 +86,9 @@ func NewPacketSerializer(localIA addr.IA, listenAddr *net.UDPAddr, remoteAddr *s
 	preparedPacket := &snet.Packet{
 		Bytes: bytes,
 		PacketInfo: snet.PacketInfo{
-			Destination: scionDestinationAddress,
+			Destination: destination,
 			Source:      scionListenAddress,
-			Path:        remoteAddr.Path,
+			Path:        path,
 			// This is a hack.
 			Payload: snet.UDPPayload{
 				Payload: make([]byte, 0),
@@ -52,7 +98,7 @@ func NewPacketSerializer(localIA addr.IA, listenAddr *net.UDPAddr, remoteAddr *s
 		},
 	}
 
-	err := preparedPacket.Serialize()
+	err = preparedPacket.Serialize()
 	if err != nil {
 		return nil, err
 	}
@@ -62,33 +108,104 @@ func NewPacketSerializer(localIA addr.IA, listenAddr *net.UDPAddr, remoteAddr *s
 	basePayloadBytes := int(binary.BigEndian.Uint16(preparedPacket.Bytes[6:8]) - 8)
 
 	pS := PacketSerializer{
-		listenAddr:       listenAddr,
-		remoteAddr:       remoteAddr,
+		srcPort:          uint16(listenAddr.Port),
+		dstPort:          dstPort,
+		mtu:              cap(preparedPacket.Bytes),
 		baseBytes:        preparedPacket.Bytes,
+		template:         append([]byte(nil), preparedPacket.Bytes[:headerBytes]...),
 		headerBytes:      headerBytes,
 		basePayloadBytes: basePayloadBytes,
 	}
 
+	if epicPath, ok := path.(*snetpath.EPIC); ok {
+		epic, err := newEPICState(epicPath, localIA, listenHost, destination.Host)
+		if err != nil {
+			return nil, err
+		}
+		pS.epic = epic
+	}
+
 	return &pS, nil
 }
 
+// hostFromIP converts ip into a SCION host address without panicking on invalid input.
+// IPv4-mapped IPv6 addresses are unmapped, so that they are encoded with a 4 byte address length.
+func hostFromIP(ip net.IP) (addr.Host, error) {
+	hostIP, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return addr.Host{}, fmt.Errorf("%w: invalid host IP %v", ErrUnsupportedAddr, ip)
+	}
+	return addr.HostIP(hostIP.Unmap()), nil
+}
+
+// packetBuffers holds the buffers connections serialize into, so that concurrent writers
+// never share a buffer.
+var packetBuffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, common.SupportedMTU)
+		return &buffer
+	},
+}
+
+// getPacketBuffer returns a buffer of packetBuffers that is large enough for the packets of pS.
+// Buffers are grown for paths with an MTU above common.SupportedMTU and stay grown once returned.
+func getPacketBuffer(pS *PacketSerializer) *[]byte {
+	bufferPtr := packetBuffers.Get().(*[]byte)
+	if len(*bufferPtr) < pS.mtu {
+		*bufferPtr = make([]byte, pS.mtu)
+	}
+	return bufferPtr
+}
+
+// Serialize writes a packet with payload b into the buffer of the serializer and returns it.
+// The result is only valid until the next call. Serialize must not be called concurrently,
+// use SerializeTo instead.
 func (pS *PacketSerializer) Serialize(b []byte) ([]byte, error) {
+	return pS.serialize(pS.baseBytes, b)
+}
+
+// SerializeTo writes a packet with payload b into buffer and returns it.
+// buffer must be large enough for the packet, i.e. at least as large as the MTU.
+// SerializeTo is safe for concurrent use, as long as every caller uses its own buffer.
+func (pS *PacketSerializer) SerializeTo(buffer []byte, b []byte) ([]byte, error) {
+	if len(buffer) < pS.mtu {
+		return nil, serrors.New("buffer smaller than MTU", "size", len(buffer), "mtu", pS.mtu)
+	}
+	copy(buffer, pS.template)
+	return pS.serialize(buffer, b)
+}
+
+// serialize fills in the length fields and the UDP header and copies b behind the prepared headers in buffer.
+func (pS *PacketSerializer) serialize(buffer []byte, b []byte) ([]byte, error) {
+
+	if len(b) > pS.MaxPayloadSize() {
+		return nil, &MessageTooBigError{
+			PayloadSize:    len(b),
+			MaxPayloadSize: pS.MaxPayloadSize(),
+		}
+	}
 
 	l4PayloadSize := 8 + len(b)
 
 	// Network Byte Order is Big Endian
-	binary.BigEndian.PutUint16(pS.baseBytes[6:8], uint16(pS.basePayloadBytes+l4PayloadSize))
-	// fmt.Println("Sending to remote address:", pS.remoteAddr.Host.IP, "Port:", pS.remoteAddr.Host.Port)
+	binary.BigEndian.PutUint16(buffer[6:8], uint16(pS.basePayloadBytes+l4PayloadSize))
+
+	if pS.epic != nil {
+		err := pS.epic.update(buffer, uint16(pS.basePayloadBytes+l4PayloadSize))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	binary.BigEndian.PutUint16(pS.baseBytes[pS.headerBytes+0:pS.headerBytes+2], uint16(pS.listenAddr.Port))
-	binary.BigEndian.PutUint16(pS.baseBytes[pS.headerBytes+2:pS.headerBytes+4], uint16(pS.remoteAddr.Host.Port))
-	binary.BigEndian.PutUint16(pS.baseBytes[pS.headerBytes+4:pS.headerBytes+6], uint16(l4PayloadSize))
-	binary.BigEndian.PutUint16(pS.baseBytes[pS.headerBytes+6:pS.headerBytes+8], uint16(0))
+	binary.BigEndian.PutUint16(buffer[pS.headerBytes+0:pS.headerBytes+2], pS.srcPort)
+	binary.BigEndian.PutUint16(buffer[pS.headerBytes+2:pS.headerBytes+4], pS.dstPort)
+	binary.BigEndian.PutUint16(buffer[pS.headerBytes+4:pS.headerBytes+6], uint16(l4PayloadSize))
+	binary.BigEndian.PutUint16(buffer[pS.headerBytes+6:pS.headerBytes+8], uint16(0))
 
-	copy(pS.baseBytes[pS.headerBytes+8:pS.headerBytes+l4PayloadSize], b)
+	copy(buffer[pS.headerBytes+8:pS.headerBytes+l4PayloadSize], b)
 
 	dataLength := pS.headerBytes + l4PayloadSize
-	return pS.baseBytes[0:dataLength], nil
+	return buffer[0:dataLength], nil
 }
 
 func (pS *PacketSerializer) GetHeaderLen() int {
@@ -97,6 +214,27 @@ func (pS *PacketSerializer) GetHeaderLen() int {
 	return pS.headerBytes + 8
 }
 
+// SetMTU limits the size of serialized packets to the MTU of the path. Values of 0 or less
+// select common.SupportedMTU, values above common.MaxMTU are capped. The buffer used by
+// Serialize grows with the MTU.
+func (pS *PacketSerializer) SetMTU(mtu int) {
+	if mtu <= 0 {
+		mtu = common.SupportedMTU
+	}
+	mtu = min(mtu, common.MaxMTU)
+	if mtu > cap(pS.baseBytes) {
+		baseBytes := make(snet.Bytes, len(pS.baseBytes), mtu)
+		copy(baseBytes, pS.baseBytes)
+		pS.baseBytes = baseBytes
+	}
+	pS.mtu = mtu
+}
+
+// MaxPayloadSize returns the largest payload that fits into a single packet on the path.
+func (pS *PacketSerializer) MaxPayloadSize() int {
+	return pS.mtu - pS.GetHeaderLen()
+}
+
 type PacketParser struct {
 	ReadBuffer []byte
 }
@@ -112,25 +250,76 @@ func NewPacketParser() (*PacketParser, error) {
 	return &packetParser, nil
 }
 
+// NextHeader returns the protocol number of the payload of the packet in ReadBuffer.
+func (pP *PacketParser) NextHeader() uint8 {
+	return pP.ReadBuffer[4]
+}
+
+// Parse copies the UDP payload of the packet in ReadBuffer into readBytes.
+// The payload is located from the end of the packet, so it works for any path type, including EPIC.
 func (pP *PacketParser) Parse(n int, readBytes []byte) (int, error) {
 	// Payload is L4 UDP, we need to unpack this too. This has a fixed length of 8 bytes.
-	nextHdr := uint16(pP.ReadBuffer[4])
+	if n < 12 {
+		return 0, ErrTruncatedPacket
+	}
+	nextHdr := pP.ReadBuffer[4]
 
 	if nextHdr != SCION_PROTOCOL_NUMBER_SCION_UDP {
-		return 0, errors.New("Unknown Packet: " + fmt.Sprint(nextHdr))
+		return 0, &UnknownNextHeaderError{NextHeader: nextHdr}
 	}
 
+	hdrLen := int(pP.ReadBuffer[5]) * 4
 	udpPayloadLen := int(binary.BigEndian.Uint16(pP.ReadBuffer[6:8]))
+	if udpPayloadLen < 8 || hdrLen+udpPayloadLen > n {
+		return 0, fmt.Errorf("%w: %d bytes, headers announce %d bytes", ErrTruncatedPacket, n, hdrLen+udpPayloadLen)
+	}
 
 	payloadLen := udpPayloadLen - 8
 	startPos := n - payloadLen
 
-	//srcPort := binary.BigEndian.Uint16(pP.ReadBuffer[startPos-8 : startPos-6])
-	//dstPort := binary.BigEndian.Uint16(pP.ReadBuffer[startPos-6 : startPos-4])
-
-	// fmt.Println("Got UDP Packet with SrcPort:", srcPort, "DstPort:", dstPort, "PayloadLen:", payloadLen)
-
 	copy(readBytes, pP.ReadBuffer[startPos:n])
 
 	return payloadLen, nil
 }
+
+// Source returns the SCION source address and the UDP source port of the UDP packet of length n in ReadBuffer.
+// Only IPv4 and IPv6 source hosts are supported.
+func (pP *PacketParser) Source(n int) (addr.IA, netip.AddrPort, error) {
+	return pP.address(n, false)
+}
+
+// Destination returns the SCION destination address and the UDP destination port of the UDP packet of
+// length n in ReadBuffer. Only IPv4 and IPv6 destination hosts are supported.
+func (pP *PacketParser) Destination(n int) (addr.IA, netip.AddrPort, error) {
+	return pP.address(n, true)
+}
+
+func (pP *PacketParser) address(n int, destination bool) (addr.IA, netip.AddrPort, error) {
+	// Common header of 12 bytes, followed by the destination and source IA.
+	const addrOffset = 12 + 16
+	if n < addrOffset {
+		return 0, netip.AddrPort{}, ErrTruncatedPacket
+	}
+	buffer := pP.ReadBuffer[:n]
+	hdrLen := int(buffer[5]) * 4
+	dstType, dstLen := buffer[9]>>6&0x3, 4*(int(buffer[9]>>4&0x3)+1)
+	srcType, srcLen := buffer[9]>>2&0x3, 4*(int(buffer[9]&0x3)+1)
+	if hdrLen+8 > n || addrOffset+dstLen+srcLen > hdrLen {
+		return 0, netip.AddrPort{}, ErrTruncatedPacket
+	}
+
+	// The IA and the host of the source follow those of the destination,
+	// the UDP source port precedes the destination port.
+	iaOffset, hostType, hostOffset, hostLen, portOffset := 20, srcType, addrOffset+dstLen, srcLen, hdrLen
+	if destination {
+		iaOffset, hostType, hostOffset, hostLen, portOffset = 12, dstType, addrOffset, dstLen, hdrLen+2
+	}
+	if hostType != 0 || (hostLen != 4 && hostLen != 16) {
+		return 0, netip.AddrPort{}, ErrNotIPHost
+	}
+
+	ia := addr.IA(binary.BigEndian.Uint64(buffer[iaOffset : iaOffset+8]))
+	host, _ := netip.AddrFromSlice(buffer[hostOffset : hostOffset+hostLen])
+	port := binary.BigEndian.Uint16(buffer[portOffset : portOffset+2])
+	return ia, netip.AddrPortFrom(host, port), nil
+}
@@ -0,0 +1,132 @@
+package optimizedconn
+
+import (
+	"cmp"
+	"sort"
+
+	"github.com/scionproto/scion/pkg/snet"
+	"github.com/scionproto/scion/private/path/pathpol"
+)
+
+// PathPreference orders paths that passed the filters of a PathPolicy.
+type PathPreference int
+
+const (
+	// PreferLowLatency prefers paths with a low sum of announced latencies.
+	PreferLowLatency PathPreference = iota
+	// PreferHighBandwidth prefers paths with a high announced bottleneck bandwidth.
+	PreferHighBandwidth
+	// PreferFewHops prefers paths traversing few interfaces.
+	PreferFewHops
+	// PreferLargeMTU prefers paths with a large MTU.
+	PreferLargeMTU
+	// PreferLongExpiry prefers paths that stay valid the longest.
+	PreferLongExpiry
+)
+
+// PathPolicy restricts and orders the paths looked up from the daemon,
+// before a PathSelector picks one of them.
+type PathPolicy struct {
+	// ACL removes paths traversing a denied interface.
+	ACL *pathpol.ACL
+	// Sequence only keeps paths matching the sequence expression.
+	Sequence *pathpol.Sequence
+	// Preferences order the remaining paths. Earlier preferences take precedence,
+	// later ones only break ties. The daemon order is kept for paths that are equal.
+	Preferences []PathPreference
+}
+
+// NewPathPolicy creates a policy from ACL entries (e.g. "- 1-ff00:0:133#0", "+") and a
+// sequence expression (e.g. "1-ff00:0:111 1-ff00:0:112 0*"). Empty values disable the filter.
+func NewPathPolicy(aclEntries []string, sequence string, preferences ...PathPreference) (*PathPolicy, error) {
+	policy := PathPolicy{
+		Preferences: preferences,
+	}
+
+	if len(aclEntries) > 0 {
+		entries := make([]*pathpol.ACLEntry, len(aclEntries))
+		for i, str := range aclEntries {
+			entries[i] = &pathpol.ACLEntry{}
+			if err := entries[i].LoadFromString(str); err != nil {
+				return nil, err
+			}
+		}
+		acl, err := pathpol.NewACL(entries...)
+		if err != nil {
+			return nil, err
+		}
+		policy.ACL = acl
+	}
+
+	if sequence != "" {
+		seq, err := pathpol.NewSequence(sequence)
+		if err != nil {
+			return nil, err
+		}
+		policy.Sequence = seq
+	}
+
+	return &policy, nil
+}
+
+// Apply filters paths and sorts the result according to the preferences.
+// The passed slice is not modified.
+func (pP *PathPolicy) Apply(paths []snet.Path) []snet.Path {
+	filtered := pathpol.NewPolicy("", pP.ACL, pP.Sequence, nil).Filter(paths)
+	if len(pP.Preferences) == 0 {
+		return filtered
+	}
+
+	sorted := append([]snet.Path(nil), filtered...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		for _, preference := range pP.Preferences {
+			if c := comparePaths(preference, sorted[i], sorted[j]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return sorted
+}
+
+// comparePaths returns a negative value if a is preferred over b and a positive value if b is preferred.
+func comparePaths(preference PathPreference, a, b snet.Path) int {
+	switch preference {
+	case PreferLowLatency:
+		return cmp.Compare(pathLatency(a), pathLatency(b))
+	case PreferHighBandwidth:
+		return cmp.Compare(pathBandwidth(b), pathBandwidth(a))
+	case PreferFewHops:
+		return cmp.Compare(pathHops(a), pathHops(b))
+	case PreferLargeMTU:
+		return cmp.Compare(announcedMTU(b), announcedMTU(a))
+	case PreferLongExpiry:
+		return pathExpiry(b).Compare(pathExpiry(a))
+	default:
+		return 0
+	}
+}
+
+// pathBandwidth returns the bottleneck bandwidth of path in Kbit/s, 0 if unknown.
+func pathBandwidth(path snet.Path) uint64 {
+	metadata := path.Metadata()
+	if metadata == nil {
+		return 0
+	}
+	var bottleneck uint64
+	for _, bandwidth := range metadata.Bandwidth {
+		if bandwidth > 0 && (bottleneck == 0 || bandwidth < bottleneck) {
+			bottleneck = bandwidth
+		}
+	}
+	return bottleneck
+}
+
+// announcedMTU returns the MTU announced in the metadata of path, 0 if unknown.
+func announcedMTU(path snet.Path) uint16 {
+	metadata := path.Metadata()
+	if metadata == nil {
+		return 0
+	}
+	return metadata.MTU
+}
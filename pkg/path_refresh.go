@@ -0,0 +1,185 @@
+package optimizedconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+const (
+	defaultPathRefreshMargin = time.Minute
+	// pathRefreshRetryInterval is the minimum time between two path lookups of the same connection.
+	pathRefreshRetryInterval = 5 * time.Second
+	pathQueryTimeout         = 10 * time.Second
+)
+
+// errPathPinned is returned by path lookups that finished after the path was pinned with SetPath.
+var errPathPinned = errors.New("path is pinned")
+
+// pathRefresher replaces the path of a dialed connection with a fresh one before the
+// hop fields of the current path expire. Writers are not interrupted, they pick up
+// the new serializer with their next Write.
+type pathRefresher struct {
+	conn *OptimizedSCIONConn
+	// remoteAddr is the dialed address, without path and next hop.
+	remoteAddr *snet.UDPAddr
+	margin     time.Duration
+
+	// ctx is canceled by stop, it aborts lookups in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newPathRefresher(conn *OptimizedSCIONConn, remoteAddr *snet.UDPAddr, margin time.Duration) *pathRefresher {
+	remoteAddr = remoteAddr.Copy()
+	remoteAddr.Path = nil
+	remoteAddr.NextHop = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pathRefresher{
+		conn:       conn,
+		remoteAddr: remoteAddr,
+		margin:     margin,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+func (pR *pathRefresher) start() {
+	pR.wg.Add(1)
+	go pR.run()
+}
+
+func (pR *pathRefresher) run() {
+	defer pR.wg.Done()
+
+	wait := pR.nextRefresh()
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-pR.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		ctx, cancel := context.WithTimeout(pR.ctx, pathQueryTimeout)
+		_, err := pR.refresh(ctx)
+		cancel()
+		if errors.Is(err, errPathPinned) || pR.stopped() {
+			return
+		}
+		if err != nil {
+			pR.conn.options.logger.Warn("Path refresh failed", "remote", pR.remoteAddr, "err", err)
+			wait = pathRefreshRetryInterval
+			continue
+		}
+		wait = pR.nextRefresh()
+	}
+}
+
+// nextRefresh returns the time to wait until the current path has to be replaced.
+// In multipath mode, all paths are replaced once the first of them is about to expire.
+// Paths of unknown expiry are treated as expired, so they are looked up again every
+// pathRefreshRetryInterval.
+func (pR *pathRefresher) nextRefresh() time.Duration {
+	expiry := pathExpiry(pR.conn.sendState.Load().path)
+	if mS := pR.conn.multipath.Load(); mS != nil {
+		for _, path := range mS.paths {
+			if pathExpiry(path).Before(expiry) {
+				expiry = pathExpiry(path)
+			}
+		}
+	}
+
+	if expiry.IsZero() {
+		return pathRefreshRetryInterval
+	}
+	wait := time.Until(expiry) - pR.margin
+	if wait < pathRefreshRetryInterval {
+		wait = pathRefreshRetryInterval
+	}
+	return wait
+}
+
+// refresh looks up the paths again and replaces the path of the connection by the selected one,
+// which it returns. If the path was pinned with SetPath, errPathPinned is returned instead.
+func (pR *pathRefresher) refresh(ctx context.Context) (*sendState, error) {
+	if pR.conn.pinned.Load() {
+		return nil, errPathPinned
+	}
+
+	remoteAddr := pR.remoteAddr.Copy()
+	if pR.conn.multipath.Load() != nil {
+		return pR.conn.setMultipath(ctx, remoteAddr)
+	}
+
+	path, err := pR.conn.connectivityContext.resolvePath(ctx, remoteAddr, &pR.conn.options)
+	if err != nil {
+		return nil, err
+	}
+
+	nextHop, err := pR.conn.connectivityContext.ResolveNextHop(ctx, remoteAddr, path)
+	if err != nil {
+		return nil, err
+	}
+	state, err := pR.conn.newSendState(remoteAddr, nextHop, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := pR.conn.storeLookedUpState(state, nil); err != nil {
+		return nil, err
+	}
+	pR.conn.options.logger.Debug("Refreshed path", "remote", remoteAddr, "path", path, "next_hop", nextHop)
+	return state, nil
+}
+
+// stop ends the refresh loop and aborts lookups in flight. It waits until the loop returned.
+func (pR *pathRefresher) stop() {
+	pR.cancel()
+	pR.wg.Wait()
+}
+
+// stopped returns whether stop was called.
+func (pR *pathRefresher) stopped() bool {
+	return pR.ctx.Err() != nil
+}
+
+// pathExpiry returns when the hop fields of path expire, the zero time for paths without
+// metadata.
+func pathExpiry(path snet.Path) time.Time {
+	if path == nil || path.Metadata() == nil {
+		return time.Time{}
+	}
+	return path.Metadata().Expiry
+}
+
+// dataplaneExpiry returns when the hop fields of a SCION dataplane path expire, the zero time
+// for other path types and paths that cannot be decoded.
+func dataplaneExpiry(dataplanePath snet.DataplanePath) time.Time {
+	scionPath, ok := dataplanePath.(snetpath.SCION)
+	if !ok {
+		return time.Time{}
+	}
+	var decoded scion.Decoded
+	if err := decoded.DecodeFromBytes(scionPath.Raw); err != nil {
+		return time.Time{}
+	}
+	return decodedPathExpiry(&decoded)
+}
+
+// checkExpiry returns an error wrapping ErrPathExpired if expiry has passed.
+// The zero time stands for an unknown expiry and is not checked.
+func checkExpiry(expiry time.Time) error {
+	if !expiry.IsZero() && time.Now().After(expiry) {
+		return fmt.Errorf("%w: expired at %s", ErrPathExpired, expiry.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package optimizedconn
+
+import (
+	"math"
+	"time"
+
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// PathSelector picks the path used to reach a remote address out of the paths returned by the daemon.
+// Select is only called with at least one path.
+type PathSelector interface {
+	Select(remoteAddr *snet.UDPAddr, paths []snet.Path) snet.Path
+}
+
+// PathSelectorFunc adapts a plain function to the PathSelector interface.
+type PathSelectorFunc func(remoteAddr *snet.UDPAddr, paths []snet.Path) snet.Path
+
+func (f PathSelectorFunc) Select(remoteAddr *snet.UDPAddr, paths []snet.Path) snet.Path {
+	return f(remoteAddr, paths)
+}
+
+// FirstPathSelector keeps the order of the daemon and always uses the first path.
+type FirstPathSelector struct{}
+
+func (FirstPathSelector) Select(_ *snet.UDPAddr, paths []snet.Path) snet.Path {
+	return paths[0]
+}
+
+// ShortestPathSelector uses the path traversing the fewest interfaces.
+// Paths without metadata are considered longer than any path with metadata.
+type ShortestPathSelector struct{}
+
+func (ShortestPathSelector) Select(_ *snet.UDPAddr, paths []snet.Path) snet.Path {
+	best := paths[0]
+	for _, path := range paths[1:] {
+		if pathHops(path) < pathHops(best) {
+			best = path
+		}
+	}
+	return best
+}
+
+// LowestLatencySelector uses the path with the lowest announced latency.
+// Hops without announced latency do not contribute to the sum.
+type LowestLatencySelector struct{}
+
+func (LowestLatencySelector) Select(_ *snet.UDPAddr, paths []snet.Path) snet.Path {
+	best := paths[0]
+	for _, path := range paths[1:] {
+		if pathLatency(path) < pathLatency(best) {
+			best = path
+		}
+	}
+	return best
+}
+
+func pathHops(path snet.Path) int {
+	metadata := path.Metadata()
+	if metadata == nil {
+		return math.MaxInt
+	}
+	return len(metadata.Interfaces)
+}
+
+func pathLatency(path snet.Path) time.Duration {
+	metadata := path.Metadata()
+	if metadata == nil {
+		return time.Duration(math.MaxInt64)
+	}
+	var total time.Duration
+	for _, latency := range metadata.Latency {
+		if latency > 0 {
+			total += latency
+		}
+	}
+	return total
+}
@@ -0,0 +1,415 @@
+package optimizedconn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/pkg/private/common"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+	"github.com/scionproto/scion/private/topology"
+)
+
+const (
+	// proberMinBackoff and proberMaxBackoff bound the delay after failed reads of the Prober socket.
+	proberMinBackoff = 10 * time.Millisecond
+	proberMaxBackoff = time.Second
+)
+
+// ProberConfig configures a Prober.
+type ProberConfig struct {
+	// Interval between two probing rounds. Defaults to one second.
+	Interval time.Duration
+	// Timeout after which a probe without reply counts as lost. Defaults to one second.
+	Timeout time.Duration
+	// Window is the number of recent probes per path the loss rate is computed over. Defaults to 20.
+	Window int
+	// Paths are the candidate paths to probe. If empty, the paths are looked up
+	// from the daemon in every round.
+	Paths []snet.Path
+	// OnResult is called for every answered or lost probe. It can be used to feed
+	// ReportProbe of a connection with failover.
+	OnResult func(path snet.Path, replied bool)
+	// ConnectivityContext is used instead of connecting to the SCION daemon, if set.
+	// The Prober holds a reference to it until it is closed.
+	ConnectivityContext *ConnectivityContext
+}
+
+// PathStats are the measurements of one path.
+type PathStats struct {
+	Path snet.Path
+	// RTT is the smoothed round trip time, LastRTT the most recent sample.
+	RTT     time.Duration
+	LastRTT time.Duration
+	// Jitter is the smoothed variation between consecutive RTT samples.
+	Jitter time.Duration
+	// Loss is the fraction of lost probes within the window.
+	Loss     float64
+	Sent     uint64
+	Received uint64
+	// LastReply is the time the last reply was received, zero if none was received yet.
+	LastReply time.Time
+}
+
+type pathProbeState struct {
+	stats PathStats
+	// window holds whether each of the recent probes was answered.
+	window []bool
+}
+
+type pendingProbe struct {
+	pathKey PathFingerprint
+	sentAt  time.Time
+}
+
+// Prober measures RTT, loss and jitter of the paths to a destination by periodically
+// sending SCMP echo requests over each of them. It uses its own socket, since the
+// border routers deliver echo replies to the port given as SCMP identifier.
+type Prober struct {
+	config              ProberConfig
+	connectivityContext *ConnectivityContext
+	transportConn       *net.UDPConn
+	localAddr           *net.UDPAddr
+	remoteAddr          *snet.UDPAddr
+	identifier          uint16
+
+	mtx     sync.Mutex
+	paths   map[PathFingerprint]*pathProbeState
+	pending map[uint16]pendingProbe
+	seq     uint16
+
+	stopOnce sync.Once
+	stopChan chan struct{}
+}
+
+// NewProber starts probing the paths from listenAddr to remoteAddr. The port of listenAddr
+// should be 0 or otherwise unused, because the prober needs a socket of its own.
+func NewProber(listenAddr *net.UDPAddr, remoteAddr *snet.UDPAddr, config ProberConfig) (*Prober, error) {
+
+	if listenAddr == nil || listenAddr.IP == nil || listenAddr.IP.IsUnspecified() {
+		return nil, ErrUnspecifiedListenAddr
+	}
+
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second
+	}
+	if config.Window <= 0 {
+		config.Window = 20
+	}
+
+	connectivityContext, err := acquireConnectivityContext(context.Background(), config.ConnectivityContext)
+	if err != nil {
+		return nil, err
+	}
+
+	transportConn, err := net.ListenUDP(listenNetwork(listenAddr), listenAddr)
+	if err != nil {
+		connectivityContext.release()
+		return nil, err
+	}
+	localAddr := transportConn.LocalAddr().(*net.UDPAddr)
+
+	p := &Prober{
+		config:              config,
+		connectivityContext: connectivityContext,
+		transportConn:       transportConn,
+		localAddr:           localAddr,
+		remoteAddr:          remoteAddr.Copy(),
+		identifier:          uint16(localAddr.Port),
+		paths:               make(map[PathFingerprint]*pathProbeState),
+		pending:             make(map[uint16]pendingProbe),
+		stopChan:            make(chan struct{}),
+	}
+
+	go p.receive()
+	go p.run()
+
+	return p, nil
+}
+
+// Stats returns the measurements of all probed paths, ordered by smoothed RTT.
+// Paths without any reply are ordered last.
+func (p *Prober) Stats() []PathStats {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	stats := make([]PathStats, 0, len(p.paths))
+	for _, state := range p.paths {
+		stats = append(stats, state.stats)
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return betterStats(stats[i], stats[j])
+	})
+	return stats
+}
+
+// PathStats returns the measurements of path, if it is probed.
+func (p *Prober) PathStats(path snet.Path) (PathStats, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	state, ok := p.paths[Fingerprint(path)]
+	if !ok {
+		return PathStats{}, false
+	}
+	return state.stats, true
+}
+
+// Selector returns a PathSelector that picks the path with the best measurements.
+// Paths that were not probed yet are only picked if no measured path is available.
+func (p *Prober) Selector() PathSelector {
+	return PathSelectorFunc(func(_ *snet.UDPAddr, paths []snet.Path) snet.Path {
+		best := paths[0]
+		bestStats, _ := p.PathStats(best)
+		for _, path := range paths[1:] {
+			stats, _ := p.PathStats(path)
+			if betterStats(stats, bestStats) {
+				best, bestStats = path, stats
+			}
+		}
+		return best
+	})
+}
+
+// Close stops probing.
+func (p *Prober) Close() error {
+	p.stopOnce.Do(func() {
+		close(p.stopChan)
+		p.connectivityContext.release()
+	})
+	return p.transportConn.Close()
+}
+
+// betterStats returns whether a is preferable over b: lower loss first, then lower RTT.
+func betterStats(a, b PathStats) bool {
+	if a.Received == 0 || b.Received == 0 {
+		return a.Received > 0 && b.Received == 0
+	}
+	if a.Loss != b.Loss {
+		return a.Loss < b.Loss
+	}
+	return a.RTT < b.RTT
+}
+
+func (p *Prober) run() {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.expire()
+		p.probeAll()
+
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Prober) candidatePaths() []snet.Path {
+	if len(p.config.Paths) > 0 {
+		return p.config.Paths
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pathQueryTimeout)
+	defer cancel()
+
+	paths, err := p.connectivityContext.paths(ctx, p.remoteAddr)
+	if err != nil {
+		return nil
+	}
+	return paths
+}
+
+func (p *Prober) probeAll() {
+	for _, path := range p.candidatePaths() {
+		p.probe(path)
+	}
+}
+
+func (p *Prober) probe(path snet.Path) {
+	destinationHost, err := hostFromIP(p.remoteAddr.Host.IP)
+	if err != nil {
+		return
+	}
+	localHost, err := hostFromIP(p.localAddr.IP)
+	if err != nil {
+		return
+	}
+
+	// SCMP has no ports, within the local AS the end host receives it on the end host port.
+	nextHop := &net.UDPAddr{
+		IP:   p.remoteAddr.Host.IP,
+		Port: topology.EndhostPort,
+		Zone: p.remoteAddr.Host.Zone,
+	}
+	if !p.connectivityContext.LocalIA.Equal(p.remoteAddr.IA) {
+		ctx, cancel := context.WithTimeout(context.Background(), pathQueryTimeout)
+		dst := &snet.UDPAddr{IA: p.remoteAddr.IA, Host: p.remoteAddr.Host}
+		nextHop, err = p.connectivityContext.ResolveNextHop(ctx, dst, path)
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+
+	key := Fingerprint(path)
+
+	p.mtx.Lock()
+	p.seq++
+	seq := p.seq
+	state, ok := p.paths[key]
+	if !ok {
+		state = &pathProbeState{stats: PathStats{Path: path}}
+		p.paths[key] = state
+	}
+	state.stats.Path = path
+	state.stats.Sent++
+	p.pending[seq] = pendingProbe{pathKey: key, sentAt: time.Now()}
+	p.mtx.Unlock()
+
+	// Serializing a packet writes to the raw path, which is shared with other users of path.
+	dataplane := path.Dataplane()
+	if scionPath, ok := dataplane.(snetpath.SCION); ok {
+		dataplane = snetpath.SCION{Raw: bytes.Clone(scionPath.Raw)}
+	}
+
+	pkt := snet.Packet{
+		Bytes: make(snet.Bytes, common.MaxMTU),
+		PacketInfo: snet.PacketInfo{
+			Destination: snet.SCIONAddress{IA: p.remoteAddr.IA, Host: destinationHost},
+			Source:      snet.SCIONAddress{IA: p.connectivityContext.LocalIA, Host: localHost},
+			Path:        dataplane,
+			Payload: snet.SCMPEchoRequest{
+				Identifier: p.identifier,
+				SeqNumber:  seq,
+			},
+		},
+	}
+	if err := pkt.Serialize(); err != nil {
+		return
+	}
+	p.transportConn.WriteTo(pkt.Bytes, nextHop)
+}
+
+func (p *Prober) receive() {
+	buffer := make([]byte, common.MaxMTU)
+	var backoff time.Duration
+	for {
+		n, err := p.transportConn.Read(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// Other errors are transient, e.g. ICMP errors reported by the socket.
+			backoff = min(max(2*backoff, proberMinBackoff), proberMaxBackoff)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-p.stopChan:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+		backoff = 0
+
+		pkt := snet.Packet{
+			Bytes: snet.Bytes(buffer[:n]),
+		}
+		if err := pkt.Decode(); err != nil {
+			continue
+		}
+		reply, ok := pkt.Payload.(snet.SCMPEchoReply)
+		if !ok || reply.Identifier != p.identifier {
+			continue
+		}
+		p.reply(reply.SeqNumber, time.Now())
+	}
+}
+
+func (p *Prober) reply(seq uint16, now time.Time) {
+	p.mtx.Lock()
+	probe, ok := p.pending[seq]
+	if !ok {
+		p.mtx.Unlock()
+		return
+	}
+	delete(p.pending, seq)
+	state := p.paths[probe.pathKey]
+
+	rtt := now.Sub(probe.sentAt)
+	stats := &state.stats
+	if stats.Received == 0 {
+		stats.RTT = rtt
+	} else {
+		// Smoothing as for TCP (RFC 6298) and RTP jitter (RFC 3550).
+		stats.RTT = (7*stats.RTT + rtt) / 8
+		stats.Jitter += (absDuration(rtt-stats.LastRTT) - stats.Jitter) / 16
+	}
+	stats.LastRTT = rtt
+	stats.LastReply = now
+	stats.Received++
+	p.record(state, true)
+	path := stats.Path
+	p.mtx.Unlock()
+
+	if p.config.OnResult != nil {
+		p.config.OnResult(path, true)
+	}
+}
+
+// expire counts all probes without reply within the timeout as lost.
+func (p *Prober) expire() {
+	var lost []snet.Path
+
+	p.mtx.Lock()
+	now := time.Now()
+	for seq, probe := range p.pending {
+		if now.Sub(probe.sentAt) < p.config.Timeout {
+			continue
+		}
+		delete(p.pending, seq)
+		state := p.paths[probe.pathKey]
+		p.record(state, false)
+		lost = append(lost, state.stats.Path)
+	}
+	p.mtx.Unlock()
+
+	if p.config.OnResult != nil {
+		for _, path := range lost {
+			p.config.OnResult(path, false)
+		}
+	}
+}
+
+// record adds the outcome of a probe to the loss window of state. p.mtx must be held.
+func (p *Prober) record(state *pathProbeState, replied bool) {
+	state.window = append(state.window, replied)
+	if len(state.window) > p.config.Window {
+		state.window = state.window[len(state.window)-p.config.Window:]
+	}
+	lost := 0
+	for _, ok := range state.window {
+		if !ok {
+			lost++
+		}
+	}
+	state.stats.Loss = float64(lost) / float64(len(state.window))
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
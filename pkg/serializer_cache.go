@@ -0,0 +1,142 @@
+package optimizedconn
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const defaultSerializerCacheSize = 1024
+
+// SerializerCacheStats are the counters of the serializer cache of an OptimizedSCIONPacketConn.
+type SerializerCacheStats struct {
+	Size     int
+	Capacity int
+	Hits     uint64
+	Misses   uint64
+	// Evictions counts entries removed because the cache was full, they were idle for
+	// longer than the TTL or their path expired.
+	Evictions uint64
+}
+
+// serializerCache is a bounded LRU cache of remote entries. Entries are evicted once the cache is
+// full, once they were not used for ttl (if set) and once the hop fields of their path expired.
+type serializerCache struct {
+	mtx      sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[remoteKey]*list.Element
+	lru      *list.List
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type serializerCacheItem struct {
+	key      remoteKey
+	entry    *remoteEntry
+	lastUsed time.Time
+}
+
+func newSerializerCache(capacity int, ttl time.Duration) *serializerCache {
+	if capacity <= 0 {
+		capacity = defaultSerializerCacheSize
+	}
+	return &serializerCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[remoteKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (sC *serializerCache) get(key remoteKey) (*remoteEntry, bool) {
+	sC.mtx.Lock()
+	defer sC.mtx.Unlock()
+
+	element, ok := sC.entries[key]
+	if !ok {
+		sC.misses++
+		return nil, false
+	}
+
+	item := element.Value.(*serializerCacheItem)
+	now := time.Now()
+	if sC.expired(item, now) {
+		sC.remove(element)
+		sC.evictions++
+		sC.misses++
+		return nil, false
+	}
+
+	item.lastUsed = now
+	sC.lru.MoveToFront(element)
+	sC.hits++
+	return item.entry, true
+}
+
+func (sC *serializerCache) put(key remoteKey, entry *remoteEntry) {
+	sC.mtx.Lock()
+	defer sC.mtx.Unlock()
+
+	now := time.Now()
+	if element, ok := sC.entries[key]; ok {
+		item := element.Value.(*serializerCacheItem)
+		item.entry = entry
+		item.lastUsed = now
+		sC.lru.MoveToFront(element)
+		return
+	}
+
+	sC.entries[key] = sC.lru.PushFront(&serializerCacheItem{
+		key:      key,
+		entry:    entry,
+		lastUsed: now,
+	})
+
+	// Drop idle entries first, then the least recently used ones until the cache fits.
+	for back := sC.lru.Back(); back != nil && sC.expired(back.Value.(*serializerCacheItem), now); back = sC.lru.Back() {
+		sC.remove(back)
+		sC.evictions++
+	}
+	for sC.lru.Len() > sC.capacity {
+		sC.remove(sC.lru.Back())
+		sC.evictions++
+	}
+}
+
+// forEach calls fn for each cached entry, in no particular order.
+func (sC *serializerCache) forEach(fn func(entry *remoteEntry)) {
+	sC.mtx.Lock()
+	defer sC.mtx.Unlock()
+
+	for element := sC.lru.Front(); element != nil; element = element.Next() {
+		fn(element.Value.(*serializerCacheItem).entry)
+	}
+}
+
+func (sC *serializerCache) stats() SerializerCacheStats {
+	sC.mtx.Lock()
+	defer sC.mtx.Unlock()
+
+	return SerializerCacheStats{
+		Size:      sC.lru.Len(),
+		Capacity:  sC.capacity,
+		Hits:      sC.hits,
+		Misses:    sC.misses,
+		Evictions: sC.evictions,
+	}
+}
+
+func (sC *serializerCache) expired(item *serializerCacheItem, now time.Time) bool {
+	if sC.ttl > 0 && now.Sub(item.lastUsed) > sC.ttl {
+		return true
+	}
+	return !item.entry.expiry.IsZero() && now.After(item.entry.expiry)
+}
+
+func (sC *serializerCache) remove(element *list.Element) {
+	sC.lru.Remove(element)
+	delete(sC.entries, element.Value.(*serializerCacheItem).key)
+}
@@ -0,0 +1,46 @@
+package optimizedconn
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// SourcePolicy decides how a connection returned by Listen handles packets from a source
+// other than the remote it learned from the first packet it received.
+type SourcePolicy int
+
+const (
+	// SourceLock keeps the learned remote for the lifetime of the connection,
+	// packets from other sources are dropped and counted by DroppedPackets. This is the default.
+	SourceLock SourcePolicy = iota
+	// SourceFollow makes the source of every packet the new remote, Write replies to whoever sent last.
+	SourceFollow
+	// SourceReject makes Read return an UnexpectedSourceError for packets from other sources.
+	// The payload of those packets is discarded.
+	SourceReject
+)
+
+func (p SourcePolicy) String() string {
+	switch p {
+	case SourceLock:
+		return "lock"
+	case SourceFollow:
+		return "follow"
+	case SourceReject:
+		return "reject"
+	default:
+		return fmt.Sprintf("SourcePolicy(%d)", int(p))
+	}
+}
+
+// isSource reports whether remoteAddr is the source ia and src of a packet.
+func isSource(remoteAddr *snet.UDPAddr, ia addr.IA, src netip.AddrPort) bool {
+	if !remoteAddr.IA.Equal(ia) {
+		return false
+	}
+	remoteHost := remoteAddr.Host.AddrPort()
+	return remoteHost.Addr().Unmap() == src.Addr() && remoteHost.Port() == src.Port()
+}
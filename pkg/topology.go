@@ -0,0 +1,257 @@
+package optimizedconn
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/drkey"
+	"github.com/scionproto/scion/pkg/private/ctrl/path_mgmt"
+	"github.com/scionproto/scion/pkg/private/serrors"
+	"github.com/scionproto/scion/pkg/segment/iface"
+	"github.com/scionproto/scion/pkg/slayers/path"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+	"github.com/scionproto/scion/private/topology"
+)
+
+// errNoDaemon is returned by the parts of the daemon API a topology file cannot provide.
+var errNoDaemon = serrors.New("not supported without SCION daemon")
+
+// NewTopologyConnectivityContext creates a ConnectivityContext that works without a SCION daemon.
+// The local IA, MTU and border router addresses are read from the topology.json at topologyFile.
+// Traffic within the local AS needs no paths, traffic to other ASes uses the given paths.
+// Pass the result to connections with WithConnectivityContext.
+func NewTopologyConnectivityContext(topologyFile string, paths []snet.Path) (*ConnectivityContext, error) {
+	topo, err := topology.RWTopologyFromJSONFile(topologyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	connector := &topologyConnector{
+		topo:  topo,
+		paths: paths,
+	}
+
+	cContext := ConnectivityContext{
+		DaemonConn: connector,
+		LocalIA:    topo.IA,
+		LocalMTU:   uint16(topo.MTU),
+	}
+
+	return &cContext, nil
+}
+
+// pathFile is the format of the files read by LoadPaths.
+type pathFile struct {
+	Paths []pathFileEntry `json:"paths"`
+}
+
+type pathFileEntry struct {
+	// Destination is the ISD-AS the path leads to.
+	Destination string `json:"destination"`
+	// Raw is the base64 encoded raw SCION path, as in the SCION header.
+	Raw string `json:"raw"`
+	// Interfaces are the interfaces on the path, e.g. "1-ff00:0:110#1". Optional.
+	Interfaces []string `json:"interfaces,omitempty"`
+	// MTU of the path. Optional, defaults to the MTU of the local AS.
+	MTU uint16 `json:"mtu,omitempty"`
+	// Expiry overrides the expiration time derived from the hop fields. Optional.
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+// LoadPaths reads pre-provisioned SCION paths from a JSON file of the form
+//
+//	{"paths": [{"destination": "1-ff00:0:112", "raw": "<base64 raw path>",
+//	  "interfaces": ["1-ff00:0:110#1", "1-ff00:0:112#2"], "mtu": 1472}]}
+//
+// The next hop of each path is the border router owning the egress interface of the
+// first hop, as listed in the topology.json at topologyFile.
+func LoadPaths(pathsFile string, topologyFile string) ([]snet.Path, error) {
+	topo, err := topology.RWTopologyFromJSONFile(topologyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := os.ReadFile(pathsFile)
+	if err != nil {
+		return nil, err
+	}
+	var file pathFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, serrors.Wrap("parsing paths file", err, "file", pathsFile)
+	}
+
+	paths := make([]snet.Path, 0, len(file.Paths))
+	for i, entry := range file.Paths {
+		path, err := entry.toPath(topo)
+		if err != nil {
+			return nil, serrors.Wrap("invalid path", err, "file", pathsFile, "index", i)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func (e *pathFileEntry) toPath(topo *topology.RWTopology) (snet.Path, error) {
+	dst, err := addr.ParseIA(e.Destination)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(e.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded scion.Decoded
+	if err := decoded.DecodeFromBytes(raw); err != nil {
+		return nil, err
+	}
+	if len(decoded.InfoFields) == 0 || len(decoded.HopFields) == 0 {
+		return nil, serrors.New("path without hops")
+	}
+
+	egress, err := firstHopEgress(snetpath.SCION{Raw: raw})
+	if err != nil {
+		return nil, err
+	}
+	ifInfo, ok := topo.IFInfoMap[iface.ID(egress)]
+	if !ok {
+		return nil, serrors.New("egress interface not in topology", "interface", egress)
+	}
+
+	metadata := snet.PathMetadata{
+		MTU:    e.MTU,
+		Expiry: e.Expiry,
+	}
+	if metadata.MTU == 0 {
+		metadata.MTU = uint16(topo.MTU)
+	}
+	if metadata.Expiry.IsZero() {
+		metadata.Expiry = decodedPathExpiry(&decoded)
+	}
+	for _, str := range e.Interfaces {
+		intf, err := parsePathInterface(str)
+		if err != nil {
+			return nil, err
+		}
+		metadata.Interfaces = append(metadata.Interfaces, intf)
+	}
+
+	return snetpath.Path{
+		Src:           topo.IA,
+		Dst:           dst,
+		DataplanePath: snetpath.SCION{Raw: raw},
+		NextHop:       net.UDPAddrFromAddrPort(ifInfo.InternalAddr),
+		Meta:          metadata,
+	}, nil
+}
+
+// decodedPathExpiry returns the earliest expiration time of all hop fields.
+func decodedPathExpiry(decoded *scion.Decoded) time.Time {
+	var expiry time.Time
+	hop := 0
+	for i, info := range decoded.InfoFields {
+		timestamp := time.Unix(int64(info.Timestamp), 0)
+		for j := 0; j < int(decoded.PathMeta.SegLen[i]); j++ {
+			hopExpiry := timestamp.Add(path.ExpTimeToDuration(decoded.HopFields[hop].ExpTime))
+			if expiry.IsZero() || hopExpiry.Before(expiry) {
+				expiry = hopExpiry
+			}
+			hop++
+		}
+	}
+	return expiry
+}
+
+// parsePathInterface parses interfaces of the form "1-ff00:0:110#1".
+func parsePathInterface(str string) (snet.PathInterface, error) {
+	iaStr, idStr, ok := strings.Cut(str, "#")
+	if !ok {
+		return snet.PathInterface{}, serrors.New("invalid interface, expected <ISD-AS>#<ID>", "interface", str)
+	}
+	ia, err := addr.ParseIA(iaStr)
+	if err != nil {
+		return snet.PathInterface{}, err
+	}
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return snet.PathInterface{}, err
+	}
+	return snet.PathInterface{IA: ia, ID: iface.ID(id)}, nil
+}
+
+// topologyConnector answers the daemon queries used by this package from a topology file
+// and a fixed set of paths.
+type topologyConnector struct {
+	topo  *topology.RWTopology
+	paths []snet.Path
+}
+
+var _ daemon.Connector = &topologyConnector{}
+
+func (tC *topologyConnector) LocalIA(_ context.Context) (addr.IA, error) {
+	return tC.topo.IA, nil
+}
+
+func (tC *topologyConnector) PortRange(_ context.Context) (uint16, uint16, error) {
+	return tC.topo.DispatchedPortStart, tC.topo.DispatchedPortEnd, nil
+}
+
+func (tC *topologyConnector) Interfaces(_ context.Context) (map[uint16]netip.AddrPort, error) {
+	interfaces := make(map[uint16]netip.AddrPort, len(tC.topo.IFInfoMap))
+	for id, info := range tC.topo.IFInfoMap {
+		interfaces[uint16(id)] = info.InternalAddr
+	}
+	return interfaces, nil
+}
+
+func (tC *topologyConnector) Paths(_ context.Context, dst, _ addr.IA, _ daemon.PathReqFlags) ([]snet.Path, error) {
+	var paths []snet.Path
+	for _, path := range tC.paths {
+		if path.Destination().Equal(dst) {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func (tC *topologyConnector) ASInfo(_ context.Context, ia addr.IA) (daemon.ASInfo, error) {
+	if !ia.IsZero() && !ia.Equal(tC.topo.IA) {
+		return daemon.ASInfo{}, errNoDaemon
+	}
+	return daemon.ASInfo{IA: tC.topo.IA, MTU: uint16(tC.topo.MTU)}, nil
+}
+
+func (tC *topologyConnector) SVCInfo(_ context.Context, _ []addr.SVC) (map[addr.SVC][]string, error) {
+	return nil, errNoDaemon
+}
+
+func (tC *topologyConnector) RevNotification(_ context.Context, _ *path_mgmt.RevInfo) error {
+	return nil
+}
+
+func (tC *topologyConnector) DRKeyGetASHostKey(_ context.Context, _ drkey.ASHostMeta) (drkey.ASHostKey, error) {
+	return drkey.ASHostKey{}, errNoDaemon
+}
+
+func (tC *topologyConnector) DRKeyGetHostASKey(_ context.Context, _ drkey.HostASMeta) (drkey.HostASKey, error) {
+	return drkey.HostASKey{}, errNoDaemon
+}
+
+func (tC *topologyConnector) DRKeyGetHostHostKey(_ context.Context, _ drkey.HostHostMeta) (drkey.HostHostKey, error) {
+	return drkey.HostHostKey{}, errNoDaemon
+}
+
+func (tC *topologyConnector) Close() error {
+	return nil
+}
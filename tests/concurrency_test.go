@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+const (
+	concurrentWriters  = 8
+	messagesPerWriter  = 10
+	concurrentMessages = concurrentWriters * messagesPerWriter
+)
+
+// message returns a payload that can be checked for corruption by checkMessage.
+func message(writer, seq int) string {
+	prefix := fmt.Sprintf("%d-%d:", writer, seq)
+	return prefix + strings.Repeat(prefix, 20)
+}
+
+func checkMessage(t *testing.T, received map[string]bool, msg string) {
+	t.Helper()
+	prefix, _, ok := strings.Cut(msg, ":")
+	if !ok || msg != prefix+":"+strings.Repeat(prefix+":", 20) {
+		t.Errorf("corrupted message %q", msg)
+		return
+	}
+	if received[msg] {
+		t.Errorf("duplicate message %q", msg)
+	}
+	received[msg] = true
+}
+
+// receiveAll reads from conn until count messages arrived or no message arrived for a second.
+func receiveAll(t *testing.T, conn net.PacketConn, count int) map[string]bool {
+	t.Helper()
+	received := make(map[string]bool)
+	buf := make([]byte, 1500)
+	for len(received) < count {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Errorf("received %d of %d messages: %v", len(received), count, err)
+			return received
+		}
+		checkMessage(t, received, string(buf[:n]))
+	}
+	return received
+}
+
+// writeConcurrently calls write from concurrentWriters goroutines with messagesPerWriter messages each.
+// The returned channel is closed once all writers are done.
+func writeConcurrently(t *testing.T, write func(writer int, msg []byte) error) <-chan struct{} {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < concurrentWriters; w++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for seq := 0; seq < messagesPerWriter; seq++ {
+				if err := write(writer, []byte(message(writer, seq))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// dialRemote dials remote, which can be reached over the returned paths.
+func dialRemote(t *testing.T, remote net.PacketConn, opts ...optimizedconn.Option) (*optimizedconn.OptimizedSCIONConn, []snet.Path) {
+	t.Helper()
+	paths := []snet.Path{
+		optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)),
+		optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, remote.LocalAddr().(*net.UDPAddr)),
+	}
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, paths...)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.Dial(loopback(), remoteUDPAddr(remote), append(opts, optimizedconn.WithConnectivityContext(cC))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, paths
+}
+
+func TestConcurrentWrite(t *testing.T) {
+	remote := listenRemote(t)
+	conn, _ := dialRemote(t, remote)
+
+	done := writeConcurrently(t, func(_ int, msg []byte) error {
+		_, err := conn.Write(msg)
+		return err
+	})
+	receiveAll(t, remote, concurrentMessages)
+	<-done
+}
+
+func TestConcurrentWriteWhileSwitchingPaths(t *testing.T) {
+	remote := listenRemote(t)
+	conn, paths := dialRemote(t, remote)
+
+	stop := make(chan struct{})
+	switched := make(chan struct{})
+	go func() {
+		defer close(switched)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := conn.SetPath(paths[i%len(paths)]); err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Path()
+			conn.MaxPayloadSize()
+		}
+	}()
+
+	done := writeConcurrently(t, func(_ int, msg []byte) error {
+		_, err := conn.Write(msg)
+		return err
+	})
+	receiveAll(t, remote, concurrentMessages)
+	<-done
+	close(stop)
+	<-switched
+}
+
+func TestConcurrentRead(t *testing.T) {
+	// The remote replies over a path of its own, the connection drops packets from any other source.
+	remoteDaemon := optimizedconntest.NewFakeDaemon(remoteIA)
+	sender, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(newConnectivityContext(t, remoteDaemon)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	conn, _ := dialRemote(t, sender)
+	remoteDaemon.SetPaths(localIA, optimizedconntest.NewFakePath(remoteIA, localIA, 2, 1, conn.LocalAddr().(*net.UDPAddr)))
+	localAddr := &snet.UDPAddr{IA: localIA, Host: conn.LocalAddr().(*net.UDPAddr)}
+
+	var mtx sync.Mutex
+	received := make(map[string]bool)
+	var wg sync.WaitGroup
+	for r := 0; r < concurrentWriters; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1500)
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				mtx.Lock()
+				checkMessage(t, received, string(buf[:n]))
+				complete := len(received) == concurrentMessages
+				mtx.Unlock()
+				if complete {
+					conn.SetReadDeadline(time.Now())
+				}
+			}
+		}()
+	}
+
+	<-writeConcurrently(t, func(_ int, msg []byte) error {
+		_, err := sender.WriteTo(msg, localAddr)
+		return err
+	})
+
+	time.AfterFunc(2*time.Second, func() { conn.SetReadDeadline(time.Now()) })
+	wg.Wait()
+	if len(received) != concurrentMessages {
+		t.Errorf("received %d of %d messages", len(received), concurrentMessages)
+	}
+}
+
+func TestConcurrentWriteToManyDestinations(t *testing.T) {
+	remotes := make([]*optimizedconn.OptimizedSCIONPacketConn, 4)
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	for i := range remotes {
+		remotes[i] = listenRemote(t)
+	}
+	// All remotes share the AS, the next hop of the path is overridden per destination.
+	fakeDaemon.SetPaths(remoteIA, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, nil))
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC), optimizedconn.WithSerializerCache(2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	results := make(chan map[string]bool, len(remotes))
+	for _, remote := range remotes {
+		go func(remote net.PacketConn) {
+			results <- receiveAll(t, remote, concurrentMessages/len(remotes))
+		}(remote)
+	}
+
+	done := writeConcurrently(t, func(writer int, msg []byte) error {
+		remote := remotes[writer%len(remotes)]
+		dst := remoteUDPAddr(remote)
+		dst.NextHop = remote.LocalAddr().(*net.UDPAddr)
+		conn.CachedPaths()
+		conn.SerializerCacheStats()
+		_, err := conn.WriteTo(msg, dst)
+		return err
+	})
+
+	for range remotes {
+		<-results
+	}
+	<-done
+}
+
+func TestConcurrentWriteToSharesLookup(t *testing.T) {
+	remote := listenRemote(t)
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)))
+	cC := newConnectivityContext(t, fakeDaemon)
+	local := listenLocalRemotes(t, cC, 1)[0]
+
+	conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.WriteTo([]byte("hello"), local); err != nil {
+		t.Fatal(err)
+	}
+	pathCalls := fakeDaemon.Calls("Paths")
+
+	fakeDaemon.SetDelay(300 * time.Millisecond)
+	<-writeConcurrently(t, func(writer int, msg []byte) error {
+		if writer == 0 {
+			// Destinations that are prepared already are not blocked by the lookup.
+			time.Sleep(50 * time.Millisecond)
+			start := time.Now()
+			if _, err := conn.WriteTo(msg, local); err != nil {
+				return err
+			}
+			if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+				return fmt.Errorf("write to prepared destination took %s", elapsed)
+			}
+			return nil
+		}
+		_, err := conn.WriteTo(msg, remoteUDPAddr(remote))
+		return err
+	})
+
+	if calls := fakeDaemon.Calls("Paths") - pathCalls; calls != 1 {
+		t.Errorf("daemon queried for paths %d times, want 1", calls)
+	}
+}
+
+func TestWriteToLookupDeadline(t *testing.T) {
+	remote := listenRemote(t)
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)))
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fakeDaemon.SetDelay(5 * time.Second)
+	conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	_, err = conn.WriteTo([]byte("hello"), remoteUDPAddr(remote))
+	var daemonErr *optimizedconn.DaemonError
+	if !errors.As(err, &daemonErr) || !daemonErr.Timeout() {
+		t.Errorf("err = %v, want DaemonError timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("write returned after %s, want at the write deadline", elapsed)
+	}
+
+	// Without deadline, the lookup is bounded by the lookup timeout only.
+	fakeDaemon.SetDelay(0)
+	conn.SetWriteDeadline(time.Time{})
+	if _, err := conn.WriteTo([]byte("hello"), remoteUDPAddr(remote)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, remote); got != "hello" {
+		t.Errorf("received %q, want %q", got, "hello")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// listenSenders opens count packet conns in remoteIA that can send to localIA.
+// The path to localIA is set by the caller once the receiving connection is known.
+func listenSenders(t *testing.T, count int) (*optimizedconntest.FakeDaemon, []*optimizedconn.OptimizedSCIONPacketConn) {
+	t.Helper()
+	remoteDaemon := optimizedconntest.NewFakeDaemon(remoteIA)
+	cC := newConnectivityContext(t, remoteDaemon)
+	senders := make([]*optimizedconn.OptimizedSCIONPacketConn, count)
+	for i := range senders {
+		sender, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sender.Close() })
+		senders[i] = sender
+	}
+	return remoteDaemon, senders
+}
+
+func TestDialDropsOtherSources(t *testing.T) {
+	remoteDaemon, senders := listenSenders(t, 2)
+	remote, stranger := senders[0], senders[1]
+	conn, _ := dialRemote(t, remote)
+	remoteDaemon.SetPaths(localIA, optimizedconntest.NewFakePath(remoteIA, localIA, 2, 1, conn.LocalAddr().(*net.UDPAddr)))
+	localAddr := &snet.UDPAddr{IA: localIA, Host: conn.LocalAddr().(*net.UDPAddr)}
+
+	if _, err := stranger.WriteTo([]byte("stray"), localAddr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.WriteTo([]byte("hello"), localAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readConn(t, conn); got != "hello" {
+		t.Errorf("received %q, want %q", got, "hello")
+	}
+	if dropped := conn.DroppedPackets(); dropped != 1 {
+		t.Errorf("DroppedPackets() = %d, want 1", dropped)
+	}
+}
+
+func TestDestinationCheck(t *testing.T) {
+	remoteDaemon, senders := listenSenders(t, 1)
+	remote := senders[0]
+	conn, _ := dialRemote(t, remote, optimizedconn.WithDestinationCheck())
+	remoteDaemon.SetPaths(localIA, optimizedconntest.NewFakePath(remoteIA, localIA, 2, 1, conn.LocalAddr().(*net.UDPAddr)))
+	localHost := conn.LocalAddr().(*net.UDPAddr)
+
+	// Delivered to the socket of the connection, but addressed to another host.
+	misaddressed := &snet.UDPAddr{
+		IA:      localIA,
+		Host:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: localHost.Port},
+		NextHop: localHost,
+	}
+	if _, err := remote.WriteTo([]byte("misaddressed"), misaddressed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.WriteTo([]byte("hello"), &snet.UDPAddr{IA: localIA, Host: localHost}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readConn(t, conn); got != "hello" {
+		t.Errorf("received %q, want %q", got, "hello")
+	}
+	if dropped := conn.DroppedPackets(); dropped != 1 {
+		t.Errorf("DroppedPackets() = %d, want 1", dropped)
+	}
+}
+
+func TestSetRemoteInMultipathMode(t *testing.T) {
+	remote, other := listenRemote(t), listenRemote(t)
+	conn, paths := dialRemote(t, remote, optimizedconn.WithMultipath(2, nil))
+	if got := len(conn.Paths()); got != 2 {
+		t.Fatalf("sending over %d paths, want 2", got)
+	}
+
+	otherAddr := remoteUDPAddr(other)
+	otherAddr.Path = paths[0].Dataplane()
+	otherAddr.NextHop = other.LocalAddr().(*net.UDPAddr)
+	if err := conn.SetRemote(otherAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes alternate between the paths in multipath mode, all of them have to reach the new remote.
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if got := readString(t, other); got != "hello" {
+			t.Errorf("write %d: received %q, want %q", i, got, "hello")
+		}
+	}
+	if got := len(conn.Paths()); got != 1 {
+		t.Errorf("sending over %d paths, want 1", got)
+	}
+}
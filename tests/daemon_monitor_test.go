@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/daemon"
+)
+
+func TestMonitorDaemonReconnects(t *testing.T) {
+	failing := optimizedconntest.NewFakeDaemon(localIA)
+	replacement := optimizedconntest.NewFakeDaemon(localIA)
+
+	cC, err := optimizedconn.NewConnectivityContext(context.Background(), failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan optimizedconn.DaemonStatus, 10)
+	err = cC.MonitorDaemon(optimizedconn.DaemonMonitorConfig{
+		Interval:   10 * time.Millisecond,
+		MinBackoff: 10 * time.Millisecond,
+		Connect: func(ctx context.Context) (daemon.Connector, error) {
+			return replacement, nil
+		},
+		OnStatusChange: func(status optimizedconn.DaemonStatus) {
+			events <- status
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cC.MonitorDaemon(optimizedconn.DaemonMonitorConfig{}); !errors.Is(err, optimizedconn.ErrDaemonMonitored) {
+		t.Errorf("second MonitorDaemon: err = %v, want ErrDaemonMonitored", err)
+	}
+
+	restarted := errors.New("daemon restarted")
+	failing.SetError("LocalIA", restarted)
+
+	for _, wantHealthy := range []bool{false, true} {
+		select {
+		case status := <-events:
+			if status.Healthy != wantHealthy {
+				t.Fatalf("status = %+v, want healthy %v", status, wantHealthy)
+			}
+			if !errors.Is(status.LastError, restarted) {
+				t.Errorf("LastError = %v, want %v", status.LastError, restarted)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no status change to healthy %v", wantHealthy)
+		}
+	}
+
+	if status := cC.DaemonStatus(); !status.Healthy || status.Reconnects != 1 {
+		t.Errorf("DaemonStatus() = %+v, want healthy after 1 reconnect", status)
+	}
+	if !failing.Closed() {
+		t.Error("failed daemon connection not closed")
+	}
+	if cC.Daemon() != replacement {
+		t.Errorf("Daemon() = %v, want the replacement", cC.Daemon())
+	}
+
+	cC.Close()
+	if !replacement.Closed() {
+		t.Error("replacement daemon connection not closed with the context")
+	}
+}
+
+func TestMonitorDaemonReconnectBackoff(t *testing.T) {
+	failing := optimizedconntest.NewFakeDaemon(localIA)
+	replacement := optimizedconntest.NewFakeDaemon(localIA)
+
+	cC, err := optimizedconn.NewConnectivityContext(context.Background(), failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cC.Close()
+
+	const (
+		minBackoff = 20 * time.Millisecond
+		maxBackoff = 80 * time.Millisecond
+		failures   = 5
+	)
+	unavailable := errors.New("daemon unavailable")
+	var mtx sync.Mutex
+	var attempts []time.Time
+	err = cC.MonitorDaemon(optimizedconn.DaemonMonitorConfig{
+		Interval:   10 * time.Millisecond,
+		MinBackoff: minBackoff,
+		MaxBackoff: maxBackoff,
+		Connect: func(ctx context.Context) (daemon.Connector, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			attempts = append(attempts, time.Now())
+			if len(attempts) <= failures {
+				return nil, unavailable
+			}
+			return replacement, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing.SetError("LocalIA", errors.New("daemon restarted"))
+
+	// While connecting fails, the daemon is reported unhealthy with the error of Connect.
+	deadline := time.Now().Add(5 * time.Second)
+	for status := cC.DaemonStatus(); status.Healthy || !errors.Is(status.LastError, unavailable); status = cC.DaemonStatus() {
+		if time.Now().After(deadline) {
+			t.Fatalf("no failed reconnect, status %+v", status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if cC.Daemon() != failing {
+		t.Error("daemon connection replaced although connecting failed")
+	}
+
+	for !cC.DaemonStatus().Healthy {
+		if time.Now().After(deadline) {
+			t.Fatalf("not reconnected, status %+v", cC.DaemonStatus())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if cC.Daemon() != replacement || cC.DaemonConn != replacement {
+		t.Errorf("Daemon() = %v, DaemonConn = %v, want the replacement", cC.Daemon(), cC.DaemonConn)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(attempts) != failures+1 {
+		t.Fatalf("%d connection attempts, want %d", len(attempts), failures+1)
+	}
+	// The delay between attempts doubles with every failure, up to the maximum backoff.
+	backoff := minBackoff
+	for i := 1; i < len(attempts); i++ {
+		backoff = min(2*backoff, maxBackoff)
+		if gap := attempts[i].Sub(attempts[i-1]); gap < backoff {
+			t.Errorf("attempt %d after %s, want at least %s", i, gap, backoff)
+		}
+	}
+
+	status := cC.DaemonStatus()
+	if status.Reconnects != 1 {
+		t.Errorf("Reconnects = %d, want 1", status.Reconnects)
+	}
+	if !errors.Is(status.LastError, unavailable) {
+		t.Errorf("LastError = %v, want %v", status.LastError, unavailable)
+	}
+	if !failing.Closed() {
+		t.Error("failed daemon connection not closed")
+	}
+}
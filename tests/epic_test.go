@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	libepic "github.com/scionproto/scion/pkg/experimental/epic"
+	"github.com/scionproto/scion/pkg/slayers"
+	"github.com/scionproto/scion/pkg/slayers/path/epic"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+func TestDialEPIC(t *testing.T) {
+	// EPIC packets are checked at the next hop, here a plain UDP socket.
+	router, err := net.ListenUDP("udp4", loopback())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	path := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, router.LocalAddr().(*net.UDPAddr)).(snetpath.Path)
+	path.Meta.EpicAuths = snet.EpicAuths{
+		AuthPHVF: bytes.Repeat([]byte{1}, 16),
+		AuthLHVF: bytes.Repeat([]byte{2}, 16),
+	}
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, path)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40000}}
+	conn, err := optimizedconn.Dial(loopback(), remoteAddr, optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1500)
+	for counter := uint32(1); counter <= 2; counter++ {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		router.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := router.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var scionLayer slayers.SCION
+		if err := scionLayer.DecodeFromBytes(buf[:n], nil); err != nil {
+			t.Fatal(err)
+		}
+		epicPath, ok := scionLayer.Path.(*epic.Path)
+		if !ok {
+			t.Fatalf("path is %T, want *epic.Path", scionLayer.Path)
+		}
+		if epicPath.PktID.Counter != counter {
+			t.Errorf("packet %d: counter = %d, want %d", counter, epicPath.PktID.Counter, counter)
+		}
+		info, err := epicPath.ScionPath.GetInfoField(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := libepic.VerifyTimestamp(time.Unix(int64(info.Timestamp), 0), epicPath.PktID.Timestamp, time.Now()); err != nil {
+			t.Errorf("packet %d: %v", counter, err)
+		}
+		if err := libepic.VerifyHVF(path.Meta.EpicAuths.AuthPHVF, epicPath.PktID, &scionLayer, info.Timestamp, epicPath.PHVF, nil); err != nil {
+			t.Errorf("packet %d: PHVF: %v", counter, err)
+		}
+		if err := libepic.VerifyHVF(path.Meta.EpicAuths.AuthLHVF, epicPath.PktID, &scionLayer, info.Timestamp, epicPath.LHVF, nil); err != nil {
+			t.Errorf("packet %d: LHVF: %v", counter, err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+func TestNotConnected(t *testing.T) {
+	server := listenServer(t, optimizedconn.SourceLock)
+
+	if _, err := server.Write([]byte("hello")); !errors.Is(err, optimizedconn.ErrNotConnected) {
+		t.Errorf("Write: err = %v, want ErrNotConnected", err)
+	}
+	if err := server.SetPath(optimizedconntest.NewFakePath(remoteIA, localIA, 1, 2, nil)); !errors.Is(err, optimizedconn.ErrNotConnected) {
+		t.Errorf("SetPath: err = %v, want ErrNotConnected", err)
+	}
+}
+
+func TestMessageTooBig(t *testing.T) {
+	conn, _ := dialRemote(t, listenRemote(t))
+
+	_, err := conn.Write(make([]byte, conn.MaxPayloadSize()+1))
+	var tooBig *optimizedconn.MessageTooBigError
+	if !errors.As(err, &tooBig) || tooBig.MaxPayloadSize != conn.MaxPayloadSize() {
+		t.Fatalf("err = %v, want MessageTooBigError", err)
+	}
+	if !errors.Is(err, optimizedconn.ErrMessageTooBig) {
+		t.Errorf("err = %v, want ErrMessageTooBig", err)
+	}
+}
+
+func TestSetPathExpired(t *testing.T) {
+	remote := listenRemote(t)
+	conn, _ := dialRemote(t, remote)
+
+	expired := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)).(snetpath.Path)
+	expired.Meta.Expiry = time.Now().Add(-time.Minute)
+	if err := conn.SetPath(expired); !errors.Is(err, optimizedconn.ErrPathExpired) {
+		t.Errorf("err = %v, want ErrPathExpired", err)
+	}
+}
+
+// expiredDataplanePath returns the dataplane path of path with hop fields that expired a day ago.
+func expiredDataplanePath(t *testing.T, path snet.Path) snet.DataplanePath {
+	t.Helper()
+	raw := bytes.Clone(path.Dataplane().(snetpath.SCION).Raw)
+	var decoded scion.Decoded
+	if err := decoded.DecodeFromBytes(raw); err != nil {
+		t.Fatal(err)
+	}
+	decoded.InfoFields[0].Timestamp = uint32(time.Now().Add(-24 * time.Hour).Unix())
+	if err := decoded.SerializeTo(raw); err != nil {
+		t.Fatal(err)
+	}
+	return snetpath.SCION{Raw: raw}
+}
+
+func TestWriteToExpiredPath(t *testing.T) {
+	remote := listenRemote(t)
+	cC := newConnectivityContext(t, optimizedconntest.NewFakeDaemon(localIA))
+	conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	remoteAddr := remoteUDPAddr(remote).Copy()
+	remoteAddr.Path = expiredDataplanePath(t, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, nil))
+	remoteAddr.NextHop = remote.LocalAddr().(*net.UDPAddr)
+	if _, err := conn.WriteTo([]byte("hello"), remoteAddr); !errors.Is(err, optimizedconn.ErrPathExpired) {
+		t.Errorf("err = %v, want ErrPathExpired", err)
+	}
+	if paths := conn.CachedPaths(); len(paths) != 0 {
+		t.Errorf("cached paths %v, want none", paths)
+	}
+}
+
+func TestWriteExpiredAfterFailedRefresh(t *testing.T) {
+	remote := listenRemote(t)
+	expiring := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)).(snetpath.Path)
+	expiring.Meta.Expiry = time.Now().Add(2 * time.Second)
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, expiring)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.Dial(loopback(), remoteUDPAddr(remote), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	lookups := fakeDaemon.Calls("Paths")
+	fakeDaemon.SetError("Paths", errors.New("daemon unavailable"))
+
+	// The first refresh happens after five seconds, when the path has already expired.
+	deadline := time.Now().Add(10 * time.Second)
+	for fakeDaemon.Calls("Paths") == lookups {
+		if time.Now().After(deadline) {
+			t.Fatal("path was not refreshed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := conn.Write([]byte("hello")); !errors.Is(err, optimizedconn.ErrPathExpired) {
+		t.Errorf("err = %v, want ErrPathExpired", err)
+	}
+}
+
+func TestUnsupportedAddr(t *testing.T) {
+	cC := newConnectivityContext(t, optimizedconntest.NewFakeDaemon(localIA))
+	conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	udpAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	if _, err := conn.WriteTo([]byte("hello"), udpAddr); !errors.Is(err, optimizedconn.ErrUnsupportedAddr) {
+		t.Errorf("WriteTo: err = %v, want ErrUnsupportedAddr", err)
+	}
+	if _, err := conn.MaxPayloadSize(udpAddr); !errors.Is(err, optimizedconn.ErrUnsupportedAddr) {
+		t.Errorf("MaxPayloadSize: err = %v, want ErrUnsupportedAddr", err)
+	}
+}
+
+func TestUnspecifiedListenAddr(t *testing.T) {
+	unspecified := &net.UDPAddr{IP: net.IPv4zero, Port: 31000}
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40000}}
+
+	for name, open := range map[string]func() error{
+		"Listen": func() error {
+			_, err := optimizedconn.Listen(unspecified)
+			return err
+		},
+		"ListenPacket": func() error {
+			_, err := optimizedconn.ListenPacket(unspecified)
+			return err
+		},
+		"NewListener": func() error {
+			_, err := optimizedconn.NewListener(unspecified)
+			return err
+		},
+		"NewProber": func() error {
+			_, err := optimizedconn.NewProber(unspecified, remoteAddr, optimizedconn.ProberConfig{})
+			return err
+		},
+	} {
+		if err := open(); !errors.Is(err, optimizedconn.ErrUnspecifiedListenAddr) {
+			t.Errorf("%s: err = %v, want ErrUnspecifiedListenAddr", name, err)
+		}
+	}
+}
+
+func TestSetPathNil(t *testing.T) {
+	conn, _ := dialRemote(t, listenRemote(t))
+
+	if err := conn.SetPath(nil); !errors.Is(err, optimizedconn.ErrNilPath) {
+		t.Errorf("err = %v, want ErrNilPath", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	listenAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 31000}
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 31001}, Path: snetpath.Empty{}}
+	packetSerializer, err := optimizedconn.NewPacketSerializer(localIA, listenAddr, remoteAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := packetSerializer.Serialize([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packetParser, err := optimizedconn.NewPacketParser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := copy(packetParser.ReadBuffer, packet)
+
+	if _, err := packetParser.Parse(n-1, make([]byte, 1500)); !errors.Is(err, optimizedconn.ErrTruncatedPacket) {
+		t.Errorf("truncated packet: err = %v, want ErrTruncatedPacket", err)
+	}
+
+	// Mark the source host as a service address.
+	packetParser.ReadBuffer[9] |= 1 << 2
+	if _, _, err := packetParser.Source(n); !errors.Is(err, optimizedconn.ErrNotIPHost) {
+		t.Errorf("service source: err = %v, want ErrNotIPHost", err)
+	}
+	packetParser.ReadBuffer[9] &^= 1 << 2
+
+	packetParser.ReadBuffer[4] = 6
+	_, err = packetParser.Parse(n, make([]byte, 1500))
+	var unknown *optimizedconn.UnknownNextHeaderError
+	if !errors.As(err, &unknown) || unknown.NextHeader != 6 || !errors.Is(err, optimizedconn.ErrUnknownNextHeader) {
+		t.Errorf("err = %v, want UnknownNextHeaderError for next header 6", err)
+	}
+}
+
+func TestSCMPError(t *testing.T) {
+	remote := listenRemote(t)
+	conn, paths := dialRemote(t, remote)
+
+	// quote serializes a packet as conn sends it to dst.
+	quote := func(dst *snet.UDPAddr) []byte {
+		t.Helper()
+		dst = dst.Copy()
+		dst.Path = paths[0].Dataplane()
+		packetSerializer, err := optimizedconn.NewPacketSerializer(localIA, conn.LocalAddr().(*net.UDPAddr), dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, err := packetSerializer.Serialize([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append([]byte(nil), packet...)
+	}
+	otherRemote := remoteUDPAddr(remote).Copy()
+	otherRemote.Host.Port++
+
+	router, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	// A border router of the local AS reports the interface of the path down. Messages without
+	// a quote or quoting a packet to another destination are dropped.
+	for _, payload := range [][]byte{nil, quote(otherRemote), quote(remoteUDPAddr(remote))} {
+		pkt := snet.Packet{
+			PacketInfo: snet.PacketInfo{
+				Source:      snet.SCIONAddress{IA: localIA, Host: addr.MustParseHost("127.0.0.9")},
+				Destination: snet.SCIONAddress{IA: localIA, Host: addr.HostIP(conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr())},
+				Path:        snetpath.Empty{},
+				Payload:     snet.SCMPExternalInterfaceDown{IA: localIA, Interface: 1, Payload: payload},
+			},
+		}
+		if err := pkt.Serialize(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := router.Write(pkt.Bytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1500))
+	var scmpErr *optimizedconn.SCMPError
+	if !errors.As(err, &scmpErr) || !scmpErr.Source.IA.Equal(localIA) {
+		t.Fatalf("err = %v, want SCMPError from %s", err, localIA)
+	}
+	if !errors.Is(err, optimizedconn.ErrPathDown) {
+		t.Errorf("err = %v, want ErrPathDown", err)
+	}
+	if dropped := conn.DroppedPackets(); dropped != 2 {
+		t.Errorf("DroppedPackets() = %d, want 2", dropped)
+	}
+}
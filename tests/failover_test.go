@@ -0,0 +1,334 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/slayers"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+// listenRouter opens a plain UDP socket standing in for the border router of the local AS.
+func listenRouter(t *testing.T) *net.UDPConn {
+	t.Helper()
+	router, err := net.ListenUDP("udp4", loopback())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { router.Close() })
+	return router
+}
+
+// sendSCMP sends an SCMP message from router to conn.
+func sendSCMP(t *testing.T, router *net.UDPConn, conn interface{ LocalAddr() net.Addr }, msg snet.Payload) {
+	t.Helper()
+	pkt := snet.Packet{
+		PacketInfo: snet.PacketInfo{
+			Source:      snet.SCIONAddress{IA: localIA, Host: addr.HostIP(router.LocalAddr().(*net.UDPAddr).AddrPort().Addr())},
+			Destination: snet.SCIONAddress{IA: localIA, Host: addr.HostIP(conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr())},
+			Path:        snetpath.Empty{},
+			Payload:     msg,
+		},
+	}
+	if err := pkt.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router.WriteTo(pkt.Bytes, conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextEvent waits for the next path switch reported to events.
+func nextEvent(t *testing.T, events <-chan optimizedconn.FailoverEvent) optimizedconn.FailoverEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no path switch")
+		return optimizedconn.FailoverEvent{}
+	}
+}
+
+func checkEvent(t *testing.T, event optimizedconn.FailoverEvent, from, to snet.Path) {
+	t.Helper()
+	if optimizedconn.Fingerprint(event.From) != optimizedconn.Fingerprint(from) || optimizedconn.Fingerprint(event.To) != optimizedconn.Fingerprint(to) {
+		t.Errorf("switched from %v to %v, want from %v to %v", event.From, event.To, from, to)
+	}
+}
+
+func TestFailoverDestinationUnreachable(t *testing.T) {
+	router := listenRouter(t)
+	routerAddr := router.LocalAddr().(*net.UDPAddr)
+	paths := []snet.Path{
+		optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, routerAddr),
+		optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, routerAddr),
+	}
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, paths...)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	events := make(chan optimizedconn.FailoverEvent, 4)
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40000}}
+	conn, err := optimizedconn.Dial(loopback(), remoteAddr,
+		optimizedconn.WithConnectivityContext(cC),
+		optimizedconn.WithMultipath(2, nil),
+		optimizedconn.WithFailover(optimizedconn.FailoverConfig{
+			OnSwitch: func(event optimizedconn.FailoverEvent) { events <- event },
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Find a packet sent over the second path, the one the remote is unreachable over.
+	var quote []byte
+	buf := make([]byte, 1500)
+	for quote == nil {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		router.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := router.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var scionLayer slayers.SCION
+		if err := scionLayer.DecodeFromBytes(buf[:n], gopacket.NilDecodeFeedback); err != nil {
+			t.Fatal(err)
+		}
+		if hop, err := scionLayer.Path.(*scion.Raw).GetHopField(0); err == nil && hop.ConsEgress == 3 {
+			quote = append([]byte(nil), buf[:n]...)
+		}
+	}
+
+	// SCMP messages are handled by Read.
+	go conn.Read(make([]byte, 1500))
+
+	// Quotes that do not match any path do not mark a path down.
+	sendSCMP(t, router, conn, snet.SCMPDestinationUnreachable{Payload: []byte("garbage")})
+	sendSCMP(t, router, conn, snet.SCMPDestinationUnreachable{Payload: quote})
+	checkEvent(t, nextEvent(t, events), paths[1], paths[0])
+
+	if got := conn.Paths(); len(got) != 1 || optimizedconn.Fingerprint(got[0]) != optimizedconn.Fingerprint(paths[0]) {
+		t.Errorf("Paths() = %v, want only %v", got, paths[0])
+	}
+}
+
+func TestFailoverPostponesSwitch(t *testing.T) {
+	remote := listenRemote(t)
+	remoteHost := remote.LocalAddr().(*net.UDPAddr)
+	paths := []snet.Path{
+		optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remoteHost),
+		optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, remoteHost),
+		optimizedconntest.NewFakePath(localIA, remoteIA, 5, 6, remoteHost),
+	}
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, paths...)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	const minSwitchInterval = 300 * time.Millisecond
+	events := make(chan optimizedconn.FailoverEvent, 4)
+	conn, err := optimizedconn.Dial(loopback(), remoteUDPAddr(remote),
+		optimizedconn.WithConnectivityContext(cC),
+		optimizedconn.WithFailover(optimizedconn.FailoverConfig{
+			LossThreshold:     1,
+			MinSwitchInterval: minSwitchInterval,
+			OnSwitch:          func(event optimizedconn.FailoverEvent) { events <- event },
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.ReportProbe(paths[0], false)
+	checkEvent(t, nextEvent(t, events), paths[0], paths[1])
+	switched := time.Now()
+
+	// The second failure is within the switch interval, the switch happens once it ended.
+	conn.ReportProbe(paths[1], false)
+	checkEvent(t, nextEvent(t, events), paths[1], paths[2])
+	if elapsed := time.Since(switched); elapsed < minSwitchInterval/2 {
+		t.Errorf("switched again after %s, want about %s", elapsed, minSwitchInterval)
+	}
+}
+
+func TestPacketConnOnSwitchUsesConn(t *testing.T) {
+	remote := listenRemote(t)
+	remoteHost := remote.LocalAddr().(*net.UDPAddr)
+	paths := []snet.Path{
+		optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remoteHost),
+		optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, remoteHost),
+	}
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, paths...)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	var conn *optimizedconn.OptimizedSCIONPacketConn
+	events := make(chan optimizedconn.FailoverEvent, 1)
+	conn, err := optimizedconn.ListenPacket(loopback(),
+		optimizedconn.WithConnectivityContext(cC),
+		optimizedconn.WithFailover(optimizedconn.FailoverConfig{
+			LossThreshold: 1,
+			OnSwitch: func(event optimizedconn.FailoverEvent) {
+				conn.CachedPaths()
+				events <- event
+			},
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.WriteTo([]byte("first"), remoteUDPAddr(remote)); err != nil {
+		t.Fatal(err)
+	}
+	conn.ReportProbe(paths[0], false)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.WriteTo([]byte("second"), remoteUDPAddr(remote))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("WriteTo blocked by the OnSwitch callback")
+	}
+	checkEvent(t, nextEvent(t, events), paths[0], paths[1])
+}
+
+func TestPacketConnIgnoresOffPathSCMP(t *testing.T) {
+	router := listenRouter(t)
+	remote := listenRemote(t)
+	remoteHost := remote.LocalAddr().(*net.UDPAddr)
+	paths := []snet.Path{
+		optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remoteHost),
+		optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, remoteHost),
+	}
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, paths...)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	events := make(chan optimizedconn.FailoverEvent, 4)
+	conn, err := optimizedconn.ListenPacket(loopback(),
+		optimizedconn.WithConnectivityContext(cC),
+		optimizedconn.WithFailover(optimizedconn.FailoverConfig{
+			OnSwitch: func(event optimizedconn.FailoverEvent) { events <- event },
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// quoteFrom serializes a packet sent from the port of from to the remote over the first path.
+	quoteFrom := func(from *net.UDPAddr) []byte {
+		t.Helper()
+		dst := remoteUDPAddr(remote)
+		dst.Path = paths[0].Dataplane()
+		packetSerializer, err := optimizedconn.NewPacketSerializer(localIA, from, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, err := packetSerializer.Serialize([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append([]byte(nil), packet...)
+	}
+	write := func() {
+		t.Helper()
+		if _, err := conn.WriteTo([]byte("hello"), remoteUDPAddr(remote)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write()
+	// SCMP messages are handled by ReadFrom.
+	go conn.ReadFrom(make([]byte, 1500))
+
+	// Messages without a quote or quoting a packet of another socket do not mark the interface down.
+	otherPort := *conn.LocalAddr().(*net.UDPAddr)
+	otherPort.Port++
+	sendSCMP(t, router, conn, snet.SCMPExternalInterfaceDown{IA: localIA, Interface: 1})
+	sendSCMP(t, router, conn, snet.SCMPExternalInterfaceDown{IA: localIA, Interface: 1, Payload: quoteFrom(&otherPort)})
+	time.Sleep(100 * time.Millisecond)
+	write()
+	select {
+	case event := <-events:
+		t.Fatalf("switched from %v to %v after off-path SCMP messages", event.From, event.To)
+	default:
+	}
+
+	sendSCMP(t, router, conn, snet.SCMPExternalInterfaceDown{IA: localIA, Interface: 1, Payload: quoteFrom(conn.LocalAddr().(*net.UDPAddr))})
+	deadline := time.Now().Add(2 * time.Second)
+	for len(events) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no path switch")
+		}
+		write()
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkEvent(t, nextEvent(t, events), paths[0], paths[1])
+}
+
+func TestSetPathDuringFailover(t *testing.T) {
+	remote := listenRemote(t)
+	remoteHost := remote.LocalAddr().(*net.UDPAddr)
+	paths := []snet.Path{
+		optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remoteHost),
+		optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, remoteHost),
+	}
+	pinned := optimizedconntest.NewFakePath(localIA, remoteIA, 5, 6, remoteHost)
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, paths...)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	events := make(chan optimizedconn.FailoverEvent, 4)
+	conn, err := optimizedconn.Dial(loopback(), remoteUDPAddr(remote),
+		optimizedconn.WithConnectivityContext(cC),
+		optimizedconn.WithMultipath(2, nil),
+		optimizedconn.WithFailover(optimizedconn.FailoverConfig{
+			LossThreshold: 1,
+			OnSwitch:      func(event optimizedconn.FailoverEvent) { events <- event },
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The lookup of the failover is still in flight when the path is pinned.
+	fakeDaemon.SetDelay(300 * time.Millisecond)
+	conn.ReportProbe(paths[0], false)
+	time.Sleep(50 * time.Millisecond)
+	if err := conn.SetPath(pinned); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		t.Errorf("switched from %v to %v after SetPath", event.From, event.To)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if got := conn.Paths(); len(got) != 1 || optimizedconn.Fingerprint(got[0]) != optimizedconn.Fingerprint(pinned) {
+		t.Errorf("Paths() = %v, want only %v", got, pinned)
+	}
+	if optimizedconn.Fingerprint(conn.Path()) != optimizedconn.Fingerprint(pinned) {
+		t.Errorf("Path() = %v, want %v", conn.Path(), pinned)
+	}
+}
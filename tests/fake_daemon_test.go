@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+var (
+	localIA  = addr.MustParseIA("1-ff00:0:110")
+	remoteIA = addr.MustParseIA("1-ff00:0:111")
+)
+
+func loopback() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func newConnectivityContext(t *testing.T, fakeDaemon *optimizedconntest.FakeDaemon) *optimizedconn.ConnectivityContext {
+	t.Helper()
+	cC, err := optimizedconn.NewConnectivityContext(context.Background(), fakeDaemon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cC.Close() })
+	return cC
+}
+
+// listenRemote opens a packet conn in remoteIA that the fake paths lead to.
+func listenRemote(t *testing.T) *optimizedconn.OptimizedSCIONPacketConn {
+	t.Helper()
+	cC := newConnectivityContext(t, optimizedconntest.NewFakeDaemon(remoteIA))
+	conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func remoteUDPAddr(conn net.PacketConn) *snet.UDPAddr {
+	return &snet.UDPAddr{IA: remoteIA, Host: conn.LocalAddr().(*net.UDPAddr)}
+}
+
+func readString(t *testing.T, conn net.PacketConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNewConnectivityContext(t *testing.T) {
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetMTU(1400)
+
+	cC := newConnectivityContext(t, fakeDaemon)
+	if !cC.LocalIA.Equal(localIA) {
+		t.Errorf("LocalIA = %s, want %s", cC.LocalIA, localIA)
+	}
+	if cC.LocalMTU != 1400 {
+		t.Errorf("LocalMTU = %d, want 1400", cC.LocalMTU)
+	}
+}
+
+func TestNewConnectivityContextDaemonError(t *testing.T) {
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	scripted := errors.New("daemon broken")
+	fakeDaemon.SetError("LocalIA", scripted)
+
+	_, err := optimizedconn.NewConnectivityContext(context.Background(), fakeDaemon)
+	var daemonErr *optimizedconn.DaemonError
+	if !errors.As(err, &daemonErr) {
+		t.Fatalf("err = %v, want DaemonError", err)
+	}
+	if !errors.Is(err, scripted) || daemonErr.Timeout() {
+		t.Errorf("err = %v, want non-timeout error wrapping %v", err, scripted)
+	}
+	if !fakeDaemon.Closed() {
+		t.Error("daemon connection not closed after failure")
+	}
+}
+
+func TestDialContextTimeout(t *testing.T) {
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	cC := newConnectivityContext(t, fakeDaemon)
+	fakeDaemon.SetDelay(time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}}
+	_, err := optimizedconn.DialContext(ctx, loopback(), remoteAddr, optimizedconn.WithConnectivityContext(cC))
+
+	var daemonErr *optimizedconn.DaemonError
+	if !errors.As(err, &daemonErr) || !daemonErr.Timeout() {
+		t.Fatalf("err = %v, want timed out DaemonError", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestDialNoPath(t *testing.T) {
+	cC := newConnectivityContext(t, optimizedconntest.NewFakeDaemon(localIA))
+
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}}
+	_, err := optimizedconn.Dial(loopback(), remoteAddr, optimizedconn.WithConnectivityContext(cC))
+	if !errors.Is(err, optimizedconn.ErrNoPath) {
+		t.Fatalf("err = %v, want ErrNoPath", err)
+	}
+}
+
+func TestDialOverFakePath(t *testing.T) {
+	remote := listenRemote(t)
+
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)))
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.Dial(loopback(), remoteUDPAddr(remote), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, remote); got != "hello" {
+		t.Errorf("received %q, want %q", got, "hello")
+	}
+	if conn.Path() == nil || len(conn.Path().Metadata().Interfaces) != 2 {
+		t.Errorf("Path() = %v, want the fake path", conn.Path())
+	}
+}
+
+func TestWriteToLooksUpPathOnce(t *testing.T) {
+	remote := listenRemote(t)
+
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)))
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, msg := range []string{"first", "second"} {
+		if _, err := conn.WriteTo([]byte(msg), remoteUDPAddr(remote)); err != nil {
+			t.Fatal(err)
+		}
+		if got := readString(t, remote); got != msg {
+			t.Errorf("received %q, want %q", got, msg)
+		}
+	}
+	if calls := fakeDaemon.Calls("Paths"); calls != 1 {
+		t.Errorf("daemon queried for paths %d times, want 1", calls)
+	}
+}
+
+func TestSharedConnectivityContext(t *testing.T) {
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	cC, err := optimizedconn.NewConnectivityContext(context.Background(), fakeDaemon)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []*optimizedconn.OptimizedSCIONPacketConn
+	for i := 0; i < 2; i++ {
+		conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+
+	cC.Close()
+	if _, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC)); !errors.Is(err, optimizedconn.ErrConnectivityContextClosed) {
+		t.Errorf("err = %v, want ErrConnectivityContextClosed", err)
+	}
+
+	for _, conn := range conns {
+		if fakeDaemon.Closed() {
+			t.Fatal("daemon connection closed while still in use")
+		}
+		conn.Close()
+		conn.Close()
+	}
+	if !fakeDaemon.Closed() {
+		t.Error("daemon connection not closed after the last connection")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+// refreshedPath returns a copy of path with other hop fields, as the daemon returns it after a refresh.
+func refreshedPath(t *testing.T, path snet.Path) snetpath.Path {
+	t.Helper()
+	refreshed := path.(snetpath.Path)
+	raw := bytes.Clone(refreshed.DataplanePath.(snetpath.SCION).Raw)
+	var decoded scion.Decoded
+	if err := decoded.DecodeFromBytes(raw); err != nil {
+		t.Fatal(err)
+	}
+	decoded.InfoFields[0].Timestamp++
+	if err := decoded.SerializeTo(raw); err != nil {
+		t.Fatal(err)
+	}
+	refreshed.DataplanePath = snetpath.SCION{Raw: raw}
+	return refreshed
+}
+
+func TestFingerprint(t *testing.T) {
+	path := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, nil)
+	refreshed := refreshedPath(t, path)
+	other := optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, nil)
+
+	if optimizedconn.Fingerprint(nil) != 0 {
+		t.Errorf("fingerprint of nil path = %d, want 0", optimizedconn.Fingerprint(nil))
+	}
+	if optimizedconn.Fingerprint(path) != optimizedconn.Fingerprint(refreshed) {
+		t.Error("refreshed path has another fingerprint")
+	}
+	if optimizedconn.Fingerprint(path) != optimizedconn.Fingerprint(&refreshed) {
+		t.Error("path pointer has another fingerprint")
+	}
+	if optimizedconn.Fingerprint(path) == optimizedconn.Fingerprint(other) {
+		t.Error("paths over other interfaces have the same fingerprint")
+	}
+
+	// The dataplane fingerprint tells the hop fields apart.
+	if optimizedconn.DataplaneFingerprint(path.Dataplane()) == optimizedconn.DataplaneFingerprint(refreshed.Dataplane()) {
+		t.Error("refreshed path has the same dataplane fingerprint")
+	}
+
+	// Without interfaces, paths are told apart by their dataplane path.
+	withoutMeta := snetpath.Path{Src: localIA, Dst: remoteIA, DataplanePath: path.Dataplane()}
+	if got, want := optimizedconn.Fingerprint(withoutMeta), optimizedconn.DataplaneFingerprint(path.Dataplane()); got != want {
+		t.Errorf("fingerprint without metadata = %d, want dataplane fingerprint %d", got, want)
+	}
+	refreshedWithoutMeta := snetpath.Path{Src: localIA, Dst: remoteIA, DataplanePath: refreshed.Dataplane()}
+	if optimizedconn.Fingerprint(withoutMeta) == optimizedconn.Fingerprint(refreshedWithoutMeta) {
+		t.Error("paths without metadata and other hop fields have the same fingerprint")
+	}
+}
+
+func TestDataplaneFingerprintPathTypes(t *testing.T) {
+	raw := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, nil).Dataplane().(snetpath.SCION).Raw
+	var decoded scion.Decoded
+	if err := decoded.DecodeFromBytes(raw); err != nil {
+		t.Fatal(err)
+	}
+
+	want := optimizedconn.DataplaneFingerprint(snetpath.SCION{Raw: raw})
+	for name, dataplanePath := range map[string]snet.DataplanePath{
+		"raw":           snet.RawPath{PathType: scion.PathType, Raw: raw},
+		"reply raw":     snet.RawReplyPath{Path: &scion.Raw{Raw: raw}},
+		"reply decoded": snet.RawReplyPath{Path: &decoded},
+	} {
+		if got := optimizedconn.DataplaneFingerprint(dataplanePath); got != want {
+			t.Errorf("%s: fingerprint = %d, want %d", name, got, want)
+		}
+	}
+	if optimizedconn.DataplaneFingerprint(snetpath.Empty{}) == want {
+		t.Error("empty path has the fingerprint of a SCION path")
+	}
+}
+
+func TestFingerprintAllocations(t *testing.T) {
+	path := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, nil)
+	var decoded scion.Decoded
+	if err := decoded.DecodeFromBytes(path.Dataplane().(snetpath.SCION).Raw); err != nil {
+		t.Fatal(err)
+	}
+	var replyPath snet.DataplanePath = snet.RawReplyPath{Path: &decoded}
+
+	if allocs := testing.AllocsPerRun(100, func() { optimizedconn.Fingerprint(path) }); allocs != 0 {
+		t.Errorf("Fingerprint allocates %.0f times, want 0", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { optimizedconn.DataplaneFingerprint(replyPath) }); allocs != 0 {
+		t.Errorf("DataplaneFingerprint of a decoded path allocates %.0f times, want 0", allocs)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+func newListener(t *testing.T) *optimizedconn.Listener {
+	t.Helper()
+	cC := newConnectivityContext(t, optimizedconntest.NewFakeDaemon(remoteIA))
+	listener, err := optimizedconn.NewListener(loopback(), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func dialListener(t *testing.T, listener *optimizedconn.Listener) *optimizedconn.OptimizedSCIONConn {
+	t.Helper()
+	listenAddr := listener.Addr().(*net.UDPAddr)
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, listenAddr))
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.Dial(loopback(), &snet.UDPAddr{IA: remoteIA, Host: listenAddr}, optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readConn(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestListenerAcceptsPerPeer(t *testing.T) {
+	listener := newListener(t)
+	clients := map[string]*optimizedconn.OptimizedSCIONConn{
+		"first":  dialListener(t, listener),
+		"second": dialListener(t, listener),
+	}
+
+	for msg, client := range clients {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		peer, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+
+		// The first packet of the peer is not lost.
+		if got := readConn(t, peer); got != msg {
+			t.Errorf("received %q, want %q", got, msg)
+		}
+		remoteAddr := peer.RemoteAddr().(*snet.UDPAddr)
+		if !remoteAddr.IA.Equal(localIA) || remoteAddr.Host.String() != client.LocalAddr().String() {
+			t.Errorf("RemoteAddr() = %s, want %s,%s", remoteAddr, localIA, client.LocalAddr())
+		}
+		if _, err := peer.Write([]byte("reply to " + msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for msg, client := range clients {
+		if got := readConn(t, client); got != "reply to "+msg {
+			t.Errorf("client received %q, want %q", got, "reply to "+msg)
+		}
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	listener := newListener(t)
+	client := dialListener(t, listener)
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener.Close()
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close: err = %v, want net.ErrClosed", err)
+	}
+	if _, err := peer.Read(make([]byte, 1500)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after Close: err = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestListenerReadDeadline(t *testing.T) {
+	listener := newListener(t)
+	client := dialListener(t, listener)
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readConn(t, peer)
+
+	peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var netErr net.Error
+	if _, err := peer.Read(make([]byte, 1500)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("err = %v, want timeout", err)
+	}
+}
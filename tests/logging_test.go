@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+)
+
+// logBuffer collects the output of a logger that may be used from several goroutines.
+type logBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lB *logBuffer) Write(p []byte) (int, error) {
+	lB.mtx.Lock()
+	defer lB.mtx.Unlock()
+	return lB.buf.Write(p)
+}
+
+func (lB *logBuffer) String() string {
+	lB.mtx.Lock()
+	defer lB.mtx.Unlock()
+	return lB.buf.String()
+}
+
+func TestWithLogger(t *testing.T) {
+	remote := listenRemote(t)
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)))
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	var logs logBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	conn, err := optimizedconn.Dial(loopback(), remoteUDPAddr(remote), optimizedconn.WithConnectivityContext(cC), optimizedconn.WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	out := logs.String()
+	for _, want := range []string{
+		"level=DEBUG",
+		`msg="Dialed remote"`,
+		"local=" + conn.LocalAddr().String(),
+		"next_hop=" + remote.LocalAddr().String(),
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output %q does not contain %q", out, want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+func checkMessageTooBig(t *testing.T, err error, maxPayloadSize int) {
+	t.Helper()
+	var tooBig *optimizedconn.MessageTooBigError
+	if !errors.As(err, &tooBig) || tooBig.MaxPayloadSize != maxPayloadSize || tooBig.PayloadSize != maxPayloadSize+1 {
+		t.Errorf("err = %v, want MessageTooBigError for %d bytes", err, maxPayloadSize+1)
+	}
+	if !errors.Is(err, optimizedconn.ErrMessageTooBig) {
+		t.Errorf("err = %v, want ErrMessageTooBig", err)
+	}
+}
+
+func TestSerializerMTU(t *testing.T) {
+	listenAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 31000}
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 31001}, Path: snetpath.Empty{}}
+	packetSerializer, err := optimizedconn.NewPacketSerializer(localIA, listenAddr, remoteAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mtu := range []int{1280, 9000} {
+		packetSerializer.SetMTU(mtu)
+		maxPayloadSize := mtu - packetSerializer.GetHeaderLen()
+		if got := packetSerializer.MaxPayloadSize(); got != maxPayloadSize {
+			t.Errorf("MTU %d: MaxPayloadSize() = %d, want %d", mtu, got, maxPayloadSize)
+		}
+
+		payload := bytes.Repeat([]byte{1}, maxPayloadSize)
+		packet, err := packetSerializer.Serialize(payload)
+		if err != nil {
+			t.Fatalf("MTU %d: %v", mtu, err)
+		}
+		if _, udp := decodePacket(t, packet); !bytes.Equal(udp.Payload, payload) {
+			t.Errorf("MTU %d: payload corrupted", mtu)
+		}
+		if _, err := packetSerializer.SerializeTo(make([]byte, mtu), payload); err != nil {
+			t.Errorf("MTU %d: SerializeTo: %v", mtu, err)
+		}
+
+		_, err = packetSerializer.Serialize(append(payload, 1))
+		checkMessageTooBig(t, err, maxPayloadSize)
+	}
+}
+
+func TestDialPathMTU(t *testing.T) {
+	remote := listenRemote(t)
+
+	// Loopback allows packets larger than the default SCION MTU.
+	path := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)).(snetpath.Path)
+	path.Meta.MTU = 9000
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, path)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.Dial(loopback(), remoteUDPAddr(remote), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	maxPayloadSize := conn.MaxPayloadSize()
+	if maxPayloadSize <= 1472 || maxPayloadSize >= 9000 {
+		t.Fatalf("MaxPayloadSize() = %d, want the path MTU of 9000 minus the headers", maxPayloadSize)
+	}
+	payload := bytes.Repeat([]byte{1}, maxPayloadSize)
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 9000)
+	n, _, err := remote.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], payload) {
+		t.Errorf("received %d bytes, want %d", n, len(payload))
+	}
+
+	_, err = conn.Write(append(payload, 1))
+	checkMessageTooBig(t, err, maxPayloadSize)
+}
+
+func TestWriteToMessageTooBig(t *testing.T) {
+	remote := listenRemote(t)
+
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetMTU(1280)
+	fakeDaemon.SetPaths(remoteIA, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)))
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Without MTU in the path metadata, the MTU of the local AS applies.
+	maxPayloadSize, err := conn.MaxPayloadSize(remoteUDPAddr(remote))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxPayloadSize >= 1280 {
+		t.Errorf("MaxPayloadSize() = %d, want less than the local MTU of 1280", maxPayloadSize)
+	}
+	_, err = conn.WriteTo(make([]byte, maxPayloadSize+1), remoteUDPAddr(remote))
+	checkMessageTooBig(t, err, maxPayloadSize)
+}
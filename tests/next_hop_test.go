@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/slayers/path/scion"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+func TestResolveNextHop(t *testing.T) {
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetInterface(1, netip.MustParseAddrPort("10.0.0.1:30001"))
+	fakeDaemon.SetInterface(2, netip.MustParseAddrPort("10.0.0.2:30002"))
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	remoteHost := &net.UDPAddr{IP: net.IPv4(10, 0, 1, 5), Port: 40000}
+	pathWithNextHop := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 30009})
+	pathViaIf1 := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, nil)
+	pathViaIf3 := optimizedconntest.NewFakePath(localIA, remoteIA, 3, 2, nil)
+
+	// The reply to a packet that arrived over pathViaIf1 leaves the local AS through the
+	// ingress interface of pathViaIf1. On arrival, the current hop is the last one.
+	var received scion.Decoded
+	if err := received.DecodeFromBytes(bytes.Clone(pathViaIf1.Dataplane().(snetpath.SCION).Raw)); err != nil {
+		t.Fatal(err)
+	}
+	received.PathMeta.CurrHF = uint8(received.NumHops - 1)
+	receivedRaw := make([]byte, received.Len())
+	if err := received.SerializeTo(receivedRaw); err != nil {
+		t.Fatal(err)
+	}
+	replyPath, err := snet.DefaultReplyPather{}.ReplyPath(snet.RawPath{
+		PathType: scion.PathType,
+		Raw:      receivedRaw,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr *snet.UDPAddr
+		path       snet.Path
+		want       string
+		wantErr    error
+	}{
+		{
+			name: "explicit next hop",
+			remoteAddr: &snet.UDPAddr{IA: remoteIA, Host: remoteHost,
+				NextHop: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 30007}},
+			path: pathWithNextHop,
+			want: "10.0.0.7:30007",
+		},
+		{
+			name:       "intra-AS",
+			remoteAddr: &snet.UDPAddr{IA: localIA, Host: remoteHost},
+			want:       "10.0.1.5:40000",
+		},
+		{
+			name:       "intra-AS same host",
+			remoteAddr: &snet.UDPAddr{IA: localIA, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}},
+			want:       "127.0.0.1:40001",
+		},
+		{
+			name:       "next hop of path",
+			remoteAddr: &snet.UDPAddr{IA: remoteIA, Host: remoteHost},
+			path:       pathWithNextHop,
+			want:       "10.0.0.9:30009",
+		},
+		{
+			name:       "egress interface of path",
+			remoteAddr: &snet.UDPAddr{IA: remoteIA, Host: remoteHost},
+			path:       pathViaIf1,
+			want:       "10.0.0.1:30001",
+		},
+		{
+			name:       "egress interface of dataplane path",
+			remoteAddr: &snet.UDPAddr{IA: remoteIA, Host: remoteHost, Path: pathViaIf1.Dataplane()},
+			want:       "10.0.0.1:30001",
+		},
+		{
+			name:       "egress interface of reply path",
+			remoteAddr: &snet.UDPAddr{IA: remoteIA, Host: remoteHost, Path: replyPath},
+			want:       "10.0.0.2:30002",
+		},
+		{
+			name:       "unknown interface",
+			remoteAddr: &snet.UDPAddr{IA: remoteIA, Host: remoteHost},
+			path:       pathViaIf3,
+			wantErr:    optimizedconn.ErrNoNextHop,
+		},
+		{
+			name:       "no path",
+			remoteAddr: &snet.UDPAddr{IA: remoteIA, Host: remoteHost},
+			wantErr:    optimizedconn.ErrNoNextHop,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nextHop, err := cC.ResolveNextHop(context.Background(), test.remoteAddr, test.path)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("err = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nextHop.String() != test.want {
+				t.Errorf("next hop = %s, want %s", nextHop, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveNextHopDaemonError(t *testing.T) {
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetError("Interfaces", errors.New("daemon broken"))
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: &net.UDPAddr{IP: net.IPv4(10, 0, 1, 5), Port: 40000}}
+	_, err := cC.ResolveNextHop(context.Background(), remoteAddr, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, nil))
+
+	var daemonErr *optimizedconn.DaemonError
+	if !errors.As(err, &daemonErr) {
+		t.Fatalf("err = %v, want DaemonError", err)
+	}
+}
+
+func TestWriteToViaNextHop(t *testing.T) {
+	routerA, routerB := listenRouter(t), listenRouter(t)
+	pathA := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, routerA.LocalAddr().(*net.UDPAddr))
+	pathB := optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, routerB.LocalAddr().(*net.UDPAddr))
+	cC := newConnectivityContext(t, optimizedconntest.NewFakeDaemon(localIA))
+	conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The next hop of the destination belongs to its path, packets over another path go to the next hop of that path.
+	for _, dst := range []net.Addr{
+		&snet.UDPAddr{
+			IA:      remoteIA,
+			Host:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40000},
+			Path:    pathA.Dataplane(),
+			NextHop: pathA.UnderlayNextHop(),
+		},
+		&snet.SVCAddr{IA: remoteIA, SVC: addr.SvcCS, Path: pathA.Dataplane(), NextHop: pathA.UnderlayNextHop()},
+	} {
+		if _, err := conn.WriteToVia([]byte("hello"), dst, pathB); err != nil {
+			t.Fatal(err)
+		}
+		routerB.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 1500)
+		n, err := routerB.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", dst, err)
+		}
+		pkt, _ := decodePacket(t, buf[:n])
+		if got, want := optimizedconn.DataplaneFingerprint(pkt.Path), optimizedconn.DataplaneFingerprint(pathB.Dataplane()); got != want {
+			t.Errorf("%s: sent over path with fingerprint %d, want %d", dst, got, want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+// decodePacket decodes a serialized packet and returns its UDP payload.
+func decodePacket(t *testing.T, packet []byte) (*snet.Packet, snet.UDPPayload) {
+	t.Helper()
+	pkt := snet.Packet{Bytes: snet.Bytes(append([]byte(nil), packet...))}
+	if err := pkt.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	udp, ok := pkt.Payload.(snet.UDPPayload)
+	if !ok {
+		t.Fatalf("payload is %T, want snet.UDPPayload", pkt.Payload)
+	}
+	return &pkt, udp
+}
+
+func TestSerializeIPv6(t *testing.T) {
+	listenAddr := &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 31000}
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: &net.UDPAddr{IP: net.ParseIP("fd00::2"), Port: 31001}, Path: snetpath.Empty{}}
+	packetSerializer, err := optimizedconn.NewPacketSerializer(localIA, listenAddr, remoteAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := packetSerializer.Serialize([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt, udp := decodePacket(t, packet)
+	if want := addr.MustParseHost("fd00::2"); !pkt.Destination.IA.Equal(remoteIA) || pkt.Destination.Host != want {
+		t.Errorf("destination = %s, want %s,%s", pkt.Destination, remoteIA, want)
+	}
+	if want := addr.MustParseHost("fd00::1"); !pkt.Source.IA.Equal(localIA) || pkt.Source.Host != want {
+		t.Errorf("source = %s, want %s,%s", pkt.Source, localIA, want)
+	}
+	if udp.SrcPort != 31000 || udp.DstPort != 31001 || string(udp.Payload) != "hello" {
+		t.Errorf("UDP %d -> %d %q, want 31000 -> 31001 %q", udp.SrcPort, udp.DstPort, udp.Payload, "hello")
+	}
+}
+
+func TestSerializeInvalidHost(t *testing.T) {
+	listenAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 31000}
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Path: snetpath.Empty{}}
+	if _, err := optimizedconn.NewPacketSerializer(localIA, listenAddr, remoteAddr); !errors.Is(err, optimizedconn.ErrUnsupportedAddr) {
+		t.Errorf("err = %v, want ErrUnsupportedAddr", err)
+	}
+
+	remoteAddr.Host = &net.UDPAddr{IP: net.IP{127, 0, 1}, Port: 31001}
+	if _, err := optimizedconn.NewPacketSerializer(localIA, listenAddr, remoteAddr); !errors.Is(err, optimizedconn.ErrUnsupportedAddr) {
+		t.Errorf("invalid host IP: err = %v, want ErrUnsupportedAddr", err)
+	}
+}
+
+func TestSerializeSVC(t *testing.T) {
+	listenAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 31000}
+	svcAddr := &snet.SVCAddr{IA: remoteIA, SVC: addr.SvcCS, Path: snetpath.Empty{}}
+	packetSerializer, err := optimizedconn.NewSVCPacketSerializer(localIA, listenAddr, svcAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := packetSerializer.Serialize([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt, udp := decodePacket(t, packet)
+	if want := addr.HostSVC(addr.SvcCS); !pkt.Destination.IA.Equal(remoteIA) || pkt.Destination.Host != want {
+		t.Errorf("destination = %s, want %s,%s", pkt.Destination, remoteIA, want)
+	}
+	if udp.SrcPort != 31000 || udp.DstPort != 0 || string(udp.Payload) != "hello" {
+		t.Errorf("UDP %d -> %d %q, want 31000 -> 0 %q", udp.SrcPort, udp.DstPort, udp.Payload, "hello")
+	}
+}
+
+func TestWriteToSVC(t *testing.T) {
+	cC := newConnectivityContext(t, optimizedconntest.NewFakeDaemon(localIA))
+	conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The service is resolved by the router at the next hop, here a plain UDP socket.
+	router, err := net.ListenUDP("udp4", loopback())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	svcAddr := &snet.SVCAddr{IA: localIA, SVC: addr.SvcCS, Path: snetpath.Empty{}, NextHop: router.LocalAddr().(*net.UDPAddr)}
+	if _, err := conn.WriteTo([]byte("hello"), svcAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	router.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := router.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, udp := decodePacket(t, buf[:n])
+	if pkt.Destination.Host != addr.HostSVC(addr.SvcCS) || !bytes.Equal(udp.Payload, []byte("hello")) {
+		t.Errorf("received %q for %s, want %q for %s", udp.Payload, pkt.Destination.Host, "hello", addr.SvcCS)
+	}
+
+	// Without a path, services are not reachable.
+	if _, err := conn.WriteTo([]byte("hello"), &snet.SVCAddr{IA: remoteIA, SVC: addr.SvcCS}); !errors.Is(err, optimizedconn.ErrNoPath) {
+		t.Errorf("err = %v, want ErrNoPath", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+// policyPath returns a fake path over the interfaces egress and ingress with the given metadata.
+func policyPath(egress, ingress uint16, mtu uint16, latency time.Duration, bandwidth uint64) snet.Path {
+	path := optimizedconntest.NewFakePath(localIA, remoteIA, egress, ingress, nil).(snetpath.Path)
+	path.Meta.MTU = mtu
+	path.Meta.Latency = []time.Duration{latency}
+	path.Meta.Bandwidth = []uint64{bandwidth}
+	return path
+}
+
+// checkPaths compares paths to want by their egress interface.
+func checkPaths(t *testing.T, paths []snet.Path, want ...uint16) {
+	t.Helper()
+	got := make([]uint16, len(paths))
+	for i, path := range paths {
+		got[i] = uint16(path.Metadata().Interfaces[0].ID)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("paths over egress interfaces %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("paths over egress interfaces %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPathPolicyFilter(t *testing.T) {
+	paths := []snet.Path{
+		policyPath(1, 2, 1400, 10*time.Millisecond, 100),
+		policyPath(3, 4, 1400, 10*time.Millisecond, 100),
+		policyPath(5, 6, 1400, 10*time.Millisecond, 100),
+	}
+
+	policy, err := optimizedconn.NewPathPolicy([]string{"- 1-ff00:0:110#3", "+"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, policy.Apply(paths), 1, 5)
+
+	policy, err = optimizedconn.NewPathPolicy(nil, "1-ff00:0:110#5 1-ff00:0:111#6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, policy.Apply(paths), 5)
+
+	// The passed paths are left untouched.
+	checkPaths(t, paths, 1, 3, 5)
+
+	if _, err := optimizedconn.NewPathPolicy([]string{"invalid"}, ""); err == nil {
+		t.Error("NewPathPolicy accepted an invalid ACL entry")
+	}
+	if _, err := optimizedconn.NewPathPolicy(nil, "1-ff00:0:110#"); err == nil {
+		t.Error("NewPathPolicy accepted an invalid sequence")
+	}
+}
+
+func TestPathPolicyPreferences(t *testing.T) {
+	paths := []snet.Path{
+		policyPath(1, 2, 1400, 30*time.Millisecond, 100),
+		policyPath(3, 4, 9000, 20*time.Millisecond, 100),
+		policyPath(5, 6, 1400, 10*time.Millisecond, 1000),
+		policyPath(7, 8, 9000, 10*time.Millisecond, 10),
+	}
+
+	tests := []struct {
+		name        string
+		preferences []optimizedconn.PathPreference
+		want        []uint16
+	}{
+		{"none", nil, []uint16{1, 3, 5, 7}},
+		{"latency", []optimizedconn.PathPreference{optimizedconn.PreferLowLatency}, []uint16{5, 7, 3, 1}},
+		{"bandwidth", []optimizedconn.PathPreference{optimizedconn.PreferHighBandwidth}, []uint16{5, 1, 3, 7}},
+		{"MTU", []optimizedconn.PathPreference{optimizedconn.PreferLargeMTU}, []uint16{3, 7, 1, 5}},
+		{"MTU then latency", []optimizedconn.PathPreference{optimizedconn.PreferLargeMTU, optimizedconn.PreferLowLatency}, []uint16{7, 3, 5, 1}},
+		{"equal hops", []optimizedconn.PathPreference{optimizedconn.PreferFewHops}, []uint16{1, 3, 5, 7}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := optimizedconn.NewPathPolicy(nil, "", test.preferences...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPaths(t, policy.Apply(paths), test.want...)
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+// shortLivedPaths returns a path to remote that expires within the default refresh margin
+// and a fresh path over other interfaces.
+func shortLivedPaths(remote net.PacketConn) (snet.Path, snet.Path) {
+	shortLived := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)).(snetpath.Path)
+	shortLived.Meta.Expiry = time.Now().Add(30 * time.Second)
+	return shortLived, optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, remote.LocalAddr().(*net.UDPAddr))
+}
+
+func TestDialRefreshesPath(t *testing.T) {
+	remote := listenRemote(t)
+	shortLived, fresh := shortLivedPaths(remote)
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, shortLived)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.Dial(loopback(), remoteUDPAddr(remote), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fakeDaemon.SetPaths(remoteIA, fresh)
+
+	// Refreshes are at least five seconds apart.
+	deadline := time.Now().Add(10 * time.Second)
+	for optimizedconn.Fingerprint(conn.Path()) != optimizedconn.Fingerprint(fresh) {
+		if time.Now().After(deadline) {
+			t.Fatalf("path %v was not replaced by %v", conn.Path(), fresh)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, remote); got != "hello" {
+		t.Errorf("received %q, want %q", got, "hello")
+	}
+}
+
+func TestDialRefreshesPathOfUnknownExpiry(t *testing.T) {
+	remote := listenRemote(t)
+	unknownExpiry := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, remote.LocalAddr().(*net.UDPAddr)).(snetpath.Path)
+	unknownExpiry.Meta.Expiry = time.Time{}
+	fresh := optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, remote.LocalAddr().(*net.UDPAddr))
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, unknownExpiry)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.Dial(loopback(), remoteUDPAddr(remote), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fakeDaemon.SetPaths(remoteIA, fresh)
+
+	// Paths of unknown expiry are looked up again after the retry interval of five seconds.
+	deadline := time.Now().Add(10 * time.Second)
+	for optimizedconn.Fingerprint(conn.Path()) != optimizedconn.Fingerprint(fresh) {
+		if time.Now().After(deadline) {
+			t.Fatalf("path %v was not replaced by %v", conn.Path(), fresh)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWriteToRefreshesPath(t *testing.T) {
+	remote := listenRemote(t)
+	shortLived, fresh := shortLivedPaths(remote)
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, shortLived)
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i, want := range []snet.Path{shortLived, fresh} {
+		if _, err := conn.WriteTo([]byte("hello"), remoteUDPAddr(remote)); err != nil {
+			t.Fatal(err)
+		}
+		if got := readString(t, remote); got != "hello" {
+			t.Errorf("received %q, want %q", got, "hello")
+		}
+		paths := conn.CachedPaths()[remoteUDPAddr(remote).String()]
+		if len(paths) != 1 || optimizedconn.Fingerprint(paths[0]) != optimizedconn.Fingerprint(want) {
+			t.Errorf("write %d: cached paths %v, want %v", i, paths, want)
+		}
+		fakeDaemon.SetPaths(remoteIA, fresh)
+	}
+	if calls := fakeDaemon.Calls("Paths"); calls != 2 {
+		t.Errorf("daemon queried for paths %d times, want 2", calls)
+	}
+}
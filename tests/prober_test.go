@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+// echoResponder answers SCMP echo requests in place of the remote host. Every second reply is
+// delayed by delay, so the RTT samples vary. If silent is set, requests are not answered.
+func echoResponder(t *testing.T, delay time.Duration, silent bool) *net.UDPConn {
+	t.Helper()
+	responder, err := net.ListenUDP("udp4", loopback())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { responder.Close() })
+
+	go func() {
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		buf := make([]byte, 1500)
+		for i := 0; ; i++ {
+			n, from, err := responder.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request := snet.Packet{Bytes: snet.Bytes(append([]byte(nil), buf[:n]...))}
+			if err := request.Decode(); err != nil {
+				continue
+			}
+			echo, ok := request.Payload.(snet.SCMPEchoRequest)
+			if !ok || silent {
+				continue
+			}
+			reply := snet.Packet{
+				Bytes: make(snet.Bytes, 1500),
+				PacketInfo: snet.PacketInfo{
+					Destination: request.Source,
+					Source:      request.Destination,
+					Path:        snetpath.Empty{},
+					Payload:     snet.SCMPEchoReply{Identifier: echo.Identifier, SeqNumber: echo.SeqNumber},
+				},
+			}
+			if err := reply.Serialize(); err != nil {
+				continue
+			}
+			wait := time.Duration(i%2) * delay
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				time.Sleep(wait)
+				responder.WriteTo(reply.Bytes, from)
+			}()
+		}
+	}()
+	return responder
+}
+
+func TestProberStats(t *testing.T) {
+	cC := newConnectivityContext(t, optimizedconntest.NewFakeDaemon(localIA))
+	answering := echoResponder(t, 20*time.Millisecond, false)
+	silent := echoResponder(t, 0, true)
+
+	answered := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, answering.LocalAddr().(*net.UDPAddr))
+	lost := optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, silent.LocalAddr().(*net.UDPAddr))
+
+	var mtx sync.Mutex
+	results := make(map[bool]int)
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}}
+	prober, err := optimizedconn.NewProber(loopback(), remoteAddr, optimizedconn.ProberConfig{
+		Interval:            10 * time.Millisecond,
+		Timeout:             100 * time.Millisecond,
+		Window:              10,
+		Paths:               []snet.Path{lost, answered},
+		ConnectivityContext: cC,
+		OnResult: func(_ snet.Path, replied bool) {
+			mtx.Lock()
+			results[replied]++
+			mtx.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prober.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		answeredStats, _ := prober.PathStats(answered)
+		lostStats, _ := prober.PathStats(lost)
+		if answeredStats.Received >= 8 && lostStats.Loss == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no stats in time: answered %+v, lost %+v", answeredStats, lostStats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := prober.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("got stats of %d paths, want 2", len(stats))
+	}
+	if optimizedconn.Fingerprint(stats[0].Path) != optimizedconn.Fingerprint(answered) {
+		t.Errorf("best path = %s, want %s", stats[0].Path, answered)
+	}
+
+	answeredStats := stats[0]
+	if answeredStats.RTT <= 0 || answeredStats.LastRTT <= 0 || answeredStats.LastReply.IsZero() {
+		t.Errorf("RTT = %s, last RTT = %s, last reply = %s, want samples", answeredStats.RTT, answeredStats.LastRTT, answeredStats.LastReply)
+	}
+	if answeredStats.RTT > 100*time.Millisecond {
+		t.Errorf("RTT = %s, want below the timeout", answeredStats.RTT)
+	}
+	// Every second reply is delayed by 20ms, so consecutive samples differ.
+	if answeredStats.Jitter <= 0 {
+		t.Errorf("jitter = %s, want > 0", answeredStats.Jitter)
+	}
+	if answeredStats.Loss != 0 {
+		t.Errorf("loss of answered path = %f, want 0", answeredStats.Loss)
+	}
+
+	lostStats := stats[1]
+	if lostStats.Received != 0 || lostStats.Sent == 0 || !lostStats.LastReply.IsZero() {
+		t.Errorf("lost path sent %d, received %d, want only sent probes", lostStats.Sent, lostStats.Received)
+	}
+
+	if got := prober.Selector().Select(remoteAddr, []snet.Path{lost, answered}); optimizedconn.Fingerprint(got) != optimizedconn.Fingerprint(answered) {
+		t.Errorf("selected %s, want %s", got, answered)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if results[true] == 0 || results[false] == 0 {
+		t.Errorf("OnResult called with %d replies and %d losses, want both", results[true], results[false])
+	}
+}
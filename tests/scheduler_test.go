@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// countWrites returns how many of n writes scheduler puts on each of paths.
+func countWrites(scheduler optimizedconn.PathScheduler, paths []snet.Path, n int) []int {
+	counts := make([]int, len(paths))
+	for i := 0; i < n; i++ {
+		counts[scheduler.Next(nil, paths)]++
+	}
+	return counts
+}
+
+func TestWeightedScheduler(t *testing.T) {
+	heavy := optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, nil)
+	light := optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, nil)
+	scheduler := &optimizedconn.WeightedScheduler{
+		Weight: func(path snet.Path) uint64 {
+			if optimizedconn.Fingerprint(path) == optimizedconn.Fingerprint(heavy) {
+				return 3
+			}
+			return 1
+		},
+	}
+
+	paths := []snet.Path{heavy, light}
+	if counts := countWrites(scheduler, paths, 4000); counts[0] < 2800 || counts[0] > 3200 {
+		t.Errorf("writes per path %v, want about 3000 and 1000", counts)
+	}
+
+	// The weights follow the paths, even if the slice is reused.
+	paths[0], paths[1] = light, heavy
+	if counts := countWrites(scheduler, paths, 4000); counts[1] < 2800 || counts[1] > 3200 {
+		t.Errorf("writes per path %v after swapping the paths, want about 1000 and 3000", counts)
+	}
+}
+
+func TestRoundRobinScheduler(t *testing.T) {
+	paths := []snet.Path{
+		optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, nil),
+		optimizedconntest.NewFakePath(localIA, remoteIA, 3, 4, nil),
+		optimizedconntest.NewFakePath(localIA, remoteIA, 5, 6, nil),
+	}
+	if counts := countWrites(&optimizedconn.RoundRobinScheduler{}, paths, 30); counts[0] != 10 || counts[1] != 10 || counts[2] != 10 {
+		t.Errorf("writes per path %v, want 10 each", counts)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// listenLocalRemotes opens count packet conns in the local AS, so no path has to be looked up for them.
+func listenLocalRemotes(t *testing.T, cC *optimizedconn.ConnectivityContext, count int) []*snet.UDPAddr {
+	t.Helper()
+	remotes := make([]*snet.UDPAddr, count)
+	for i := range remotes {
+		conn, err := optimizedconn.ListenPacket(loopback(), optimizedconn.WithConnectivityContext(cC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		remotes[i] = &snet.UDPAddr{IA: localIA, Host: conn.LocalAddr().(*net.UDPAddr)}
+	}
+	return remotes
+}
+
+func checkCacheStats(t *testing.T, conn *optimizedconn.OptimizedSCIONPacketConn, want optimizedconn.SerializerCacheStats) {
+	t.Helper()
+	if got := conn.SerializerCacheStats(); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestSerializerCacheLRU(t *testing.T) {
+	cC := newConnectivityContext(t, optimizedconntest.NewFakeDaemon(localIA))
+	remotes := listenLocalRemotes(t, cC, 3)
+	conn, err := optimizedconn.ListenPacket(loopback(),
+		optimizedconn.WithConnectivityContext(cC),
+		optimizedconn.WithSerializerCache(2, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	write := func(remote *snet.UDPAddr) {
+		t.Helper()
+		if _, err := conn.WriteTo([]byte("hello"), remote); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(remotes[0])
+	write(remotes[1])
+	write(remotes[0])
+	checkCacheStats(t, conn, optimizedconn.SerializerCacheStats{Size: 2, Capacity: 2, Hits: 1, Misses: 2})
+
+	// The cache is full, the least recently used remote is evicted.
+	write(remotes[2])
+	checkCacheStats(t, conn, optimizedconn.SerializerCacheStats{Size: 2, Capacity: 2, Hits: 1, Misses: 3, Evictions: 1})
+	if _, ok := conn.CachedPaths()[remotes[1].String()]; ok {
+		t.Errorf("%s is still cached", remotes[1])
+	}
+
+	write(remotes[0])
+	write(remotes[2])
+	checkCacheStats(t, conn, optimizedconn.SerializerCacheStats{Size: 2, Capacity: 2, Hits: 3, Misses: 3, Evictions: 1})
+
+	write(remotes[1])
+	checkCacheStats(t, conn, optimizedconn.SerializerCacheStats{Size: 2, Capacity: 2, Hits: 3, Misses: 4, Evictions: 2})
+	if _, ok := conn.CachedPaths()[remotes[0].String()]; ok {
+		t.Errorf("%s is still cached", remotes[0])
+	}
+}
+
+func TestSerializerCacheTTL(t *testing.T) {
+	cC := newConnectivityContext(t, optimizedconntest.NewFakeDaemon(localIA))
+	remotes := listenLocalRemotes(t, cC, 2)
+	conn, err := optimizedconn.ListenPacket(loopback(),
+		optimizedconn.WithConnectivityContext(cC),
+		optimizedconn.WithSerializerCache(0, 50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, remote := range remotes {
+		if _, err := conn.WriteTo([]byte("hello"), remote); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The idle entry of the written remote is replaced, the other one is dropped when adding it.
+	if _, err := conn.WriteTo([]byte("hello"), remotes[0]); err != nil {
+		t.Fatal(err)
+	}
+	checkCacheStats(t, conn, optimizedconn.SerializerCacheStats{Size: 1, Capacity: 1024, Misses: 3, Evictions: 2})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/snet"
+)
+
+// listenServer opens a connection in remoteIA that learns its remote from the first packet.
+func listenServer(t *testing.T, policy optimizedconn.SourcePolicy) *optimizedconn.OptimizedSCIONConn {
+	t.Helper()
+	cC := newConnectivityContext(t, optimizedconntest.NewFakeDaemon(remoteIA))
+	server, err := optimizedconn.Listen(loopback(), optimizedconn.WithConnectivityContext(cC), optimizedconn.WithSourcePolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func dialServer(t *testing.T, server net.Conn) *optimizedconn.OptimizedSCIONConn {
+	t.Helper()
+	serverAddr := server.LocalAddr().(*net.UDPAddr)
+	fakeDaemon := optimizedconntest.NewFakeDaemon(localIA)
+	fakeDaemon.SetPaths(remoteIA, optimizedconntest.NewFakePath(localIA, remoteIA, 1, 2, serverAddr))
+	cC := newConnectivityContext(t, fakeDaemon)
+
+	client, err := optimizedconn.Dial(loopback(), &snet.UDPAddr{IA: remoteIA, Host: serverAddr}, optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func write(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkRemote(t *testing.T, server, client net.Conn) {
+	t.Helper()
+	remoteAddr := server.RemoteAddr().(*snet.UDPAddr)
+	if remoteAddr.Host.String() != client.LocalAddr().String() {
+		t.Errorf("RemoteAddr() = %s, want %s", remoteAddr.Host, client.LocalAddr())
+	}
+}
+
+func TestListenReadsFirstPacket(t *testing.T) {
+	server := listenServer(t, optimizedconn.SourceLock)
+	client := dialServer(t, server)
+
+	write(t, client, "hello")
+	if got := readConn(t, server); got != "hello" {
+		t.Errorf("received %q, want %q", got, "hello")
+	}
+	checkRemote(t, server, client)
+
+	write(t, server, "reply")
+	if got := readConn(t, client); got != "reply" {
+		t.Errorf("client received %q, want %q", got, "reply")
+	}
+}
+
+func TestSourcePolicyLock(t *testing.T) {
+	server := listenServer(t, optimizedconn.SourceLock)
+	first, second := dialServer(t, server), dialServer(t, server)
+
+	write(t, first, "first")
+	readConn(t, server)
+	write(t, second, "intruder")
+	write(t, first, "again")
+
+	if got := readConn(t, server); got != "again" {
+		t.Errorf("received %q, want %q", got, "again")
+	}
+	checkRemote(t, server, first)
+	if dropped := server.DroppedPackets(); dropped != 1 {
+		t.Errorf("DroppedPackets() = %d, want 1", dropped)
+	}
+}
+
+func TestSourcePolicyFollow(t *testing.T) {
+	server := listenServer(t, optimizedconn.SourceFollow)
+	first, second := dialServer(t, server), dialServer(t, server)
+
+	write(t, first, "first")
+	readConn(t, server)
+	write(t, second, "second")
+
+	if got := readConn(t, server); got != "second" {
+		t.Errorf("received %q, want %q", got, "second")
+	}
+	checkRemote(t, server, second)
+
+	write(t, server, "reply")
+	if got := readConn(t, second); got != "reply" {
+		t.Errorf("client received %q, want %q", got, "reply")
+	}
+}
+
+func TestSourcePolicyReject(t *testing.T) {
+	server := listenServer(t, optimizedconn.SourceReject)
+	first, second := dialServer(t, server), dialServer(t, server)
+
+	write(t, first, "first")
+	readConn(t, server)
+	write(t, second, "intruder")
+
+	var sourceErr *optimizedconn.UnexpectedSourceError
+	if _, err := server.Read(make([]byte, 1500)); !errors.As(err, &sourceErr) {
+		t.Fatalf("err = %v, want UnexpectedSourceError", err)
+	}
+	if sourceErr.Port != uint16(second.LocalAddr().(*net.UDPAddr).Port) {
+		t.Errorf("source port = %d, want %d", sourceErr.Port, second.LocalAddr().(*net.UDPAddr).Port)
+	}
+
+	write(t, first, "again")
+	if got := readConn(t, server); got != "again" {
+		t.Errorf("received %q, want %q", got, "again")
+	}
+	checkRemote(t, server, first)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	optimizedconn "github.com/netsys-lab/scion-optimized-connection/pkg"
+	"github.com/netsys-lab/scion-optimized-connection/pkg/optimizedconntest"
+	"github.com/scionproto/scion/pkg/addr"
+	"github.com/scionproto/scion/pkg/daemon"
+	"github.com/scionproto/scion/pkg/snet"
+	snetpath "github.com/scionproto/scion/pkg/snet/path"
+)
+
+// writeTopology writes a topology.json of localIA with a border router owning interface 1,
+// which listens on routerAddr.
+func writeTopology(t *testing.T, routerAddr *net.UDPAddr) string {
+	t.Helper()
+	return writeFile(t, "topology.json", fmt.Sprintf(`{
+		"isd_as": "%s",
+		"mtu": 1400,
+		"dispatched_ports": "31000-32767",
+		"attributes": [],
+		"border_routers": {
+			"br1": {
+				"internal_addr": "%s",
+				"interfaces": {
+					"1": {
+						"underlay": {"local": "127.0.0.1:50000", "remote": "127.0.0.1:50001"},
+						"isd_as": "%s",
+						"link_to": "child",
+						"mtu": 1400
+					}
+				}
+			}
+		}
+	}`, localIA, routerAddr, remoteIA))
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// rawPath returns the base64 encoded raw path leaving the local AS through egress.
+func rawPath(egress uint16) string {
+	path := optimizedconntest.NewFakePath(localIA, remoteIA, egress, 2, nil)
+	return base64.StdEncoding.EncodeToString(path.Dataplane().(snetpath.SCION).Raw)
+}
+
+func TestLoadPaths(t *testing.T) {
+	routerAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 31002}
+	topologyFile := writeTopology(t, routerAddr)
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	pathsFile := writeFile(t, "paths.json", fmt.Sprintf(`{"paths": [
+		{"destination": "%s", "raw": "%s", "interfaces": ["%s#1", "%s#2"]},
+		{"destination": "%s", "raw": "%s", "mtu": 1280, "expiry": "%s"}
+	]}`, remoteIA, rawPath(1), localIA, remoteIA, remoteIA, rawPath(1), expiry.Format(time.RFC3339)))
+
+	paths, err := optimizedconn.LoadPaths(pathsFile, topologyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("loaded %d paths, want 2", len(paths))
+	}
+
+	for i, path := range paths {
+		if !path.Source().Equal(localIA) || !path.Destination().Equal(remoteIA) {
+			t.Errorf("path %d: %s -> %s, want %s -> %s", i, path.Source(), path.Destination(), localIA, remoteIA)
+		}
+		if nextHop := path.UnderlayNextHop(); nextHop.String() != routerAddr.String() {
+			t.Errorf("path %d: next hop = %s, want border router %s", i, nextHop, routerAddr)
+		}
+	}
+
+	meta := paths[0].Metadata()
+	want := []snet.PathInterface{{IA: localIA, ID: 1}, {IA: remoteIA, ID: 2}}
+	if len(meta.Interfaces) != 2 || meta.Interfaces[0] != want[0] || meta.Interfaces[1] != want[1] {
+		t.Errorf("interfaces = %v, want %v", meta.Interfaces, want)
+	}
+	if meta.MTU != 1400 {
+		t.Errorf("MTU = %d, want MTU of the local AS 1400", meta.MTU)
+	}
+	// Hop fields of fake paths expire after about six hours.
+	if until := time.Until(meta.Expiry); until < 5*time.Hour || until > 7*time.Hour {
+		t.Errorf("expiry = %s, want in about six hours", meta.Expiry)
+	}
+
+	meta = paths[1].Metadata()
+	if meta.MTU != 1280 || !meta.Expiry.Equal(expiry) {
+		t.Errorf("MTU = %d, expiry = %s, want 1280, %s", meta.MTU, meta.Expiry, expiry)
+	}
+}
+
+func TestLoadPathsErrors(t *testing.T) {
+	topologyFile := writeTopology(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 31002})
+	emptyPath := base64.StdEncoding.EncodeToString(make([]byte, 4))
+
+	for name, entry := range map[string]string{
+		"destination":       fmt.Sprintf(`{"destination": "1-xyz", "raw": "%s"}`, rawPath(1)),
+		"base64":            fmt.Sprintf(`{"destination": "%s", "raw": "not base64!"}`, remoteIA),
+		"no hops":           fmt.Sprintf(`{"destination": "%s", "raw": "%s"}`, remoteIA, emptyPath),
+		"unknown interface": fmt.Sprintf(`{"destination": "%s", "raw": "%s"}`, remoteIA, rawPath(7)),
+		"interface format":  fmt.Sprintf(`{"destination": "%s", "raw": "%s", "interfaces": ["%s-1"]}`, remoteIA, rawPath(1), localIA),
+		"interface id":      fmt.Sprintf(`{"destination": "%s", "raw": "%s", "interfaces": ["%s#x"]}`, remoteIA, rawPath(1), localIA),
+		"interface ISD-AS":  fmt.Sprintf(`{"destination": "%s", "raw": "%s", "interfaces": ["1-xyz#1"]}`, remoteIA, rawPath(1)),
+	} {
+		pathsFile := writeFile(t, "paths.json", fmt.Sprintf(`{"paths": [%s]}`, entry))
+		if _, err := optimizedconn.LoadPaths(pathsFile, topologyFile); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	if _, err := optimizedconn.LoadPaths(writeFile(t, "paths.json", `{"paths": [`), topologyFile); err == nil {
+		t.Error("invalid JSON: no error")
+	}
+	if _, err := optimizedconn.LoadPaths(filepath.Join(t.TempDir(), "missing.json"), topologyFile); err == nil {
+		t.Error("missing paths file: no error")
+	}
+	if _, err := optimizedconn.LoadPaths(writeFile(t, "paths.json", `{"paths": []}`), filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing topology file: no error")
+	}
+}
+
+func TestTopologyConnectivityContext(t *testing.T) {
+	router := listenRouter(t)
+	routerAddr := router.LocalAddr().(*net.UDPAddr)
+	topologyFile := writeTopology(t, routerAddr)
+	pathsFile := writeFile(t, "paths.json", fmt.Sprintf(`{"paths": [{"destination": "%s", "raw": "%s"}]}`, remoteIA, rawPath(1)))
+
+	paths, err := optimizedconn.LoadPaths(pathsFile, topologyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cC, err := optimizedconn.NewTopologyConnectivityContext(topologyFile, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cC.Close()
+
+	if !cC.LocalIA.Equal(localIA) || cC.LocalMTU != 1400 {
+		t.Errorf("local IA %s, MTU %d, want %s, 1400", cC.LocalIA, cC.LocalMTU, localIA)
+	}
+
+	ctx := context.Background()
+	if got, err := cC.DaemonConn.Paths(ctx, remoteIA, localIA, daemon.PathReqFlags{}); err != nil || len(got) != 1 {
+		t.Errorf("paths to %s = %v, %v, want the loaded path", remoteIA, got, err)
+	}
+	otherIA := addr.MustParseIA("1-ff00:0:112")
+	if got, err := cC.DaemonConn.Paths(ctx, otherIA, localIA, daemon.PathReqFlags{}); err != nil || len(got) != 0 {
+		t.Errorf("paths to %s = %v, %v, want none", otherIA, got, err)
+	}
+	if _, err := cC.DaemonConn.SVCInfo(ctx, nil); err == nil {
+		t.Error("SVCInfo: no error without daemon")
+	}
+
+	// Connections send to the border router of the egress interface of the loaded path.
+	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40000}}
+	conn, err := optimizedconn.Dial(loopback(), remoteAddr, optimizedconn.WithConnectivityContext(cC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	router.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := router.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, udp := decodePacket(t, buf[:n])
+	if !pkt.Destination.IA.Equal(remoteIA) || string(udp.Payload) != "hello" {
+		t.Errorf("router received %q for %s, want %q for %s", udp.Payload, pkt.Destination.IA, "hello", remoteIA)
+	}
+}